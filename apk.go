@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const androidManifestFileName = "AndroidManifest.xml"
+
+const (
+	xmlChunkStringPool   = 0x0001
+	xmlChunkStartElement = 0x0102
+	xmlStringPoolUTF8    = 1 << 8
+	xmlNoEntry           = 0xFFFFFFFF
+)
+
+// Install failures after which another device may still succeed, so the device is released and replaced.
+var deviceIncompatibilityFailures = []string{
+	"INSTALL_FAILED_NO_MATCHING_ABIS",
+	"INSTALL_FAILED_INSUFFICIENT_STORAGE",
+	"INSTALL_FAILED_OLDER_SDK",
+}
+
+type apkFile struct {
+	path        string
+	packageName string
+}
+
+type deviceIncompatibleError struct {
+	reason string
+}
+
+func (e deviceIncompatibleError) Error() string {
+	return "device incompatible with APK: " + e.reason
+}
+
+func readApkFiles(paths []string) ([]apkFile, error) {
+	var apks []apkFile
+	for _, path := range paths {
+		packageName, err := readApkPackageName(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read package name of %s, error: %s", path, err)
+		}
+		apks = append(apks, apkFile{path: path, packageName: packageName})
+	}
+	return apks, nil
+}
+
+func readApkPackageName(path string) (string, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Warnf("Failed to close APK file, error: %s", err)
+		}
+	}()
+	for _, file := range reader.File {
+		if file.Name != androidManifestFileName {
+			continue
+		}
+		manifestReader, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		manifest, err := ioutil.ReadAll(manifestReader)
+		if closeErr := manifestReader.Close(); closeErr != nil {
+			log.Warnf("Failed to close manifest file, error: %s", closeErr)
+		}
+		if err != nil {
+			return "", err
+		}
+		return parseManifestPackageName(manifest)
+	}
+	return "", fmt.Errorf("%s not found", androidManifestFileName)
+}
+
+// parseManifestPackageName extracts the package attribute of the root element from binary (compiled) AndroidManifest.xml.
+func parseManifestPackageName(manifest []byte) (string, error) {
+	if len(manifest) < 8 {
+		return "", errors.New("manifest too short")
+	}
+	var stringPool []string
+	offset := int(binary.LittleEndian.Uint16(manifest[2:]))
+	for offset+8 <= len(manifest) {
+		chunkType := binary.LittleEndian.Uint16(manifest[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(manifest[offset+2:]))
+		chunkSize := int(binary.LittleEndian.Uint32(manifest[offset+4:]))
+		if chunkSize < 8 || offset+chunkSize > len(manifest) {
+			return "", errors.New("malformed manifest chunk")
+		}
+		chunk := manifest[offset : offset+chunkSize]
+		switch chunkType {
+		case xmlChunkStringPool:
+			pool, err := parseStringPool(chunk)
+			if err != nil {
+				return "", err
+			}
+			stringPool = pool
+		case xmlChunkStartElement:
+			return parseRootElementPackage(chunk, headerSize, stringPool)
+		}
+		offset += chunkSize
+	}
+	return "", errors.New("manifest root element not found")
+}
+
+func parseRootElementPackage(chunk []byte, headerSize int, stringPool []string) (string, error) {
+	if len(chunk) < headerSize+20 {
+		return "", errors.New("malformed manifest element")
+	}
+	ext := chunk[headerSize:]
+	attributeStart := int(binary.LittleEndian.Uint16(ext[8:]))
+	attributeSize := int(binary.LittleEndian.Uint16(ext[10:]))
+	attributeCount := int(binary.LittleEndian.Uint16(ext[12:]))
+	for i := 0; i < attributeCount; i++ {
+		start := headerSize + attributeStart + i*attributeSize
+		if start+12 > len(chunk) {
+			return "", errors.New("malformed manifest attribute")
+		}
+		name := lookupString(stringPool, binary.LittleEndian.Uint32(chunk[start+4:]))
+		if name != "package" {
+			continue
+		}
+		value := lookupString(stringPool, binary.LittleEndian.Uint32(chunk[start+8:]))
+		if value == "" {
+			return "", errors.New("empty package attribute")
+		}
+		return value, nil
+	}
+	return "", errors.New("package attribute not found")
+}
+
+func lookupString(stringPool []string, index uint32) string {
+	if index == xmlNoEntry || int(index) >= len(stringPool) {
+		return ""
+	}
+	return stringPool[index]
+}
+
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, errors.New("malformed string pool")
+	}
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	stringCount := int(binary.LittleEndian.Uint32(chunk[8:]))
+	isUTF8 := binary.LittleEndian.Uint32(chunk[16:])&xmlStringPoolUTF8 != 0
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	if headerSize+stringCount*4 > len(chunk) {
+		return nil, errors.New("malformed string pool offsets")
+	}
+	pool := make([]string, stringCount)
+	for i := range pool {
+		start := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if start >= len(chunk) {
+			return nil, errors.New("malformed string pool entry")
+		}
+		var err error
+		if isUTF8 {
+			pool[i], err = decodeUTF8PoolString(chunk[start:])
+		} else {
+			pool[i], err = decodeUTF16PoolString(chunk[start:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+func decodeUTF8PoolString(data []byte) (string, error) {
+	_, n := decodeUTF8PoolLength(data)
+	length, m := decodeUTF8PoolLength(data[n:])
+	start := n + m
+	if start+length > len(data) {
+		return "", errors.New("malformed UTF-8 string")
+	}
+	return string(data[start : start+length]), nil
+}
+
+func decodeUTF8PoolLength(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	if data[0]&0x80 != 0 && len(data) > 1 {
+		return int(data[0]&0x7F)<<8 | int(data[1]), 2
+	}
+	return int(data[0]), 1
+}
+
+func decodeUTF16PoolString(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("malformed UTF-16 string")
+	}
+	length := int(binary.LittleEndian.Uint16(data))
+	start := 2
+	if length&0x8000 != 0 {
+		if len(data) < 4 {
+			return "", errors.New("malformed UTF-16 string")
+		}
+		length = (length&0x7FFF)<<16 | int(binary.LittleEndian.Uint16(data[2:]))
+		start = 4
+	}
+	if start+length*2 > len(data) {
+		return "", errors.New("malformed UTF-16 string")
+	}
+	chars := make([]uint16, length)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[start+i*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// installApksOnDevices releases devices incompatible with any of the APKs and returns the remaining ones.
+// Incompatible devices are recorded as failed in quarantine history if any, so they are not reserved again and again.
+func installApksOnDevices(configs configsModel, history *quarantineHistory, apks []apkFile, devices []connectedDevice) ([]connectedDevice, error) {
+	errs := make([]error, len(devices))
+	durations := make([]time.Duration, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device connectedDevice) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = installApksOnDevice(configs, apks, device)
+			durations[i] = time.Since(start)
+		}(i, device)
+	}
+	wg.Wait()
+
+	var keptDevices []connectedDevice
+	var installErr error
+	for i, device := range devices {
+		err := errs[i]
+		event := flowEvent{phase: "install", serial: device.serial, host: device.host.url, duration: durations[i], err: err}
+		if _, ok := err.(deviceIncompatibleError); ok {
+			event.logf("Device %s dropped", device.serial)
+			history.record(quarantineKey(device.host, device.serial), true, time.Now(), configs.quarantineWindow)
+			if err := releaseDevice(configs, device); err != nil {
+				log.Warnf("Could not release device %s, error: %s", device.serial, err)
+			}
+			continue
+		}
+		if err != nil {
+			event.logf("Could not install APKs on device %s", device.serial)
+			if installErr == nil {
+				installErr = fmt.Errorf("could not install APKs on device %s, error: %s", device.serial, err)
+			}
+		} else {
+			event.logf("APKs installed on device %s", device.serial)
+		}
+		keptDevices = append(keptDevices, device)
+	}
+	return keptDevices, installErr
+}
+
+func installApksOnDevice(configs configsModel, apks []apkFile, device connectedDevice) error {
+	for _, apk := range apks {
+		log.Infof("Installing %s on %s", apk.path, device.serial)
+		args := append([]string{"install"}, strings.Fields(configs.apkInstallOptions)...)
+		output, err := runAdbOnDevice(device, append(args, apk.path)...)
+		log.Debugf("%s", output)
+		for _, failure := range deviceIncompatibilityFailures {
+			if strings.Contains(output, failure) {
+				return deviceIncompatibleError{reason: failure}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s | output: %s", err, output)
+		}
+		if strings.Contains(output, "Failure") {
+			return fmt.Errorf("installation failed | output: %s", output)
+		}
+		if err := verifyPackageInstalled(device, apk.packageName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyPackageInstalled(device connectedDevice, packageName string) error {
+	output, err := runAdbOnDevice(device, "shell", "pm", "list", "packages", packageName)
+	if err != nil {
+		return fmt.Errorf("could not list packages, error: %s | output: %s", err, output)
+	}
+	if !containsPackage(output, packageName) {
+		return fmt.Errorf("package %s not found after installation", packageName)
+	}
+	return nil
+}
+
+func containsPackage(pmOutput, packageName string) bool {
+	for _, installedPackage := range parsePackageList(pmOutput) {
+		if installedPackage == packageName {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePackageList(pmOutput string) []string {
+	var packages []string
+	for _, line := range strings.Split(pmOutput, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "package:") {
+			packages = append(packages, strings.TrimPrefix(line, "package:"))
+		}
+	}
+	return packages
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestParseManifestPackageNameUTF16(t *testing.T) {
+	manifest := buildBinaryManifest(false, "com.example.app")
+	packageName, err := parseManifestPackageName(manifest)
+	require.NoError(t, err)
+	require.Equal(t, "com.example.app", packageName)
+}
+
+func TestParseManifestPackageNameUTF8(t *testing.T) {
+	manifest := buildBinaryManifest(true, "com.example.app.test")
+	packageName, err := parseManifestPackageName(manifest)
+	require.NoError(t, err)
+	require.Equal(t, "com.example.app.test", packageName)
+}
+
+func TestParseManifestPackageNameMalformed(t *testing.T) {
+	_, err := parseManifestPackageName([]byte{3, 0, 8, 0})
+	require.Error(t, err)
+
+	manifest := buildBinaryManifest(false, "com.example.app")
+	_, err = parseManifestPackageName(manifest[:len(manifest)-4])
+	require.Error(t, err)
+}
+
+func TestReadApkFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_apk_test")
+	require.NoError(t, err)
+	apkPath := filepath.Join(tempDir, "app.apk")
+	writeFakeApk(t, apkPath, buildBinaryManifest(true, "com.example.app"))
+
+	apks, err := readApkFiles([]string{apkPath})
+	require.NoError(t, err)
+	require.Equal(t, []apkFile{{path: apkPath, packageName: "com.example.app"}}, apks)
+
+	_, err = readApkFiles([]string{filepath.Join(tempDir, "missing.apk")})
+	require.Error(t, err)
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestContainsPackage(t *testing.T) {
+	output := "package:com.example.app.test\npackage:com.example.app\n"
+	require.True(t, containsPackage(output, "com.example.app"))
+	require.True(t, containsPackage(output, "com.example.app.test"))
+	require.False(t, containsPackage(output, "com.example"))
+}
+
+func TestInstallApksOnDevicesReleasesIncompatibleDevices(t *testing.T) {
+	var releasedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			releasedPaths = append(releasedPaths, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	fake.on("adb -s arm:7401 install", "Failure [INSTALL_FAILED_NO_MATCHING_ABIS]", nil)
+	fake.on("adb -s old:7401 install", "Failure [INSTALL_FAILED_VERSION_DOWNGRADE]", nil)
+	fake.on("adb -s", "package:com.example.app", nil)
+	host := stfHost{url: server.URL, accessToken: "token"}
+	arm := connectedDevice{serial: "arm", host: host, remoteConnectURL: "arm:7401"}
+	x86 := connectedDevice{serial: "x86", host: host, remoteConnectURL: "x86:7401"}
+	old := connectedDevice{serial: "old", host: host, remoteConnectURL: "old:7401"}
+	apks := []apkFile{{path: "app.apk", packageName: "com.example.app"}}
+	configs := configsModel{controlTimeout: time.Second, quarantineWindow: 10}
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{}}
+
+	devices, err := installApksOnDevices(configs, history, apks, []connectedDevice{arm, x86})
+	require.NoError(t, err)
+	require.Equal(t, []connectedDevice{x86}, devices)
+	require.Equal(t, []string{userDevicesEndpoint + "/arm"}, releasedPaths)
+	require.Equal(t, []string{"adb disconnect arm:7401"}, fake.callsWithPrefix("adb disconnect"))
+	require.Len(t, history.Devices[quarantineKey(host, "arm")], 1)
+	require.True(t, history.Devices[quarantineKey(host, "arm")][0].Failed)
+	require.Empty(t, history.Devices[quarantineKey(host, "x86")])
+
+	devices, err = installApksOnDevices(configs, nil, apks, []connectedDevice{old})
+	require.EqualError(t, err, "could not install APKs on device old, error: installation failed | output: Failure [INSTALL_FAILED_VERSION_DOWNGRADE]")
+	require.Equal(t, []connectedDevice{old}, devices)
+	require.Len(t, releasedPaths, 1)
+}
+
+func writeFakeApk(t *testing.T, path string, manifest []byte) {
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	writer := zip.NewWriter(file)
+	entry, err := writer.Create(androidManifestFileName)
+	require.NoError(t, err)
+	_, err = entry.Write(manifest)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, file.Close())
+}
+
+// buildBinaryManifest produces minimal compiled XML with <manifest package="..."> root element.
+func buildBinaryManifest(utf8 bool, packageName string) []byte {
+	stringPool := buildStringPool(utf8, []string{"manifest", "package", packageName})
+
+	var element bytes.Buffer
+	writeLittleEndian(&element, uint32(0), uint32(xmlNoEntry))
+	writeLittleEndian(&element, uint32(xmlNoEntry), uint32(0), uint16(20), uint16(20), uint16(1), uint16(0), uint16(0), uint16(0))
+	writeLittleEndian(&element, uint32(xmlNoEntry), uint32(1), uint32(2), uint16(8), uint8(0), uint8(3), uint32(2))
+	startElement := buildChunk(xmlChunkStartElement, 16, element.Bytes()[8:], element.Bytes()[:8])
+
+	body := append(stringPool, startElement...)
+	return buildChunk(0x0003, 8, body, nil)
+}
+
+func buildStringPool(utf8 bool, values []string) []byte {
+	var data bytes.Buffer
+	offsets := make([]uint32, len(values))
+	for i, value := range values {
+		offsets[i] = uint32(data.Len())
+		if utf8 {
+			writeLittleEndian(&data, uint8(len(value)), uint8(len(value)))
+			data.WriteString(value)
+			data.WriteByte(0)
+		} else {
+			chars := utf16.Encode([]rune(value))
+			writeLittleEndian(&data, uint16(len(chars)), chars, uint16(0))
+		}
+	}
+	var flags uint32
+	if utf8 {
+		flags = xmlStringPoolUTF8
+	}
+	var header bytes.Buffer
+	headerSize := 28
+	writeLittleEndian(&header, uint32(len(values)), uint32(0), flags, uint32(headerSize+4*len(values)), uint32(0))
+	var offsetTable bytes.Buffer
+	writeLittleEndian(&offsetTable, offsets)
+	return buildChunk(xmlChunkStringPool, uint16(headerSize), append(offsetTable.Bytes(), data.Bytes()...), header.Bytes())
+}
+
+func buildChunk(chunkType, headerSize uint16, body, extraHeader []byte) []byte {
+	var chunk bytes.Buffer
+	writeLittleEndian(&chunk, chunkType, headerSize, uint32(8+len(extraHeader)+len(body)))
+	chunk.Write(extraHeader)
+	chunk.Write(body)
+	return chunk.Bytes()
+}
+
+func writeLittleEndian(buffer *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		if err := binary.Write(buffer, binary.LittleEndian, value); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestParsePackageList(t *testing.T) {
+	require.Equal(t, []string{"com.example.app", "com.android.settings"}, parsePackageList("package:com.example.app\r\npackage:com.android.settings\n\n"))
+	require.Nil(t, parsePackageList(""))
+}
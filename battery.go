@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+)
+
+var badBatteryHealths = []string{"overheat", "dead", "over_voltage", "cold", "unspecified_failure"}
+
+//Battery ...
+type Battery struct {
+	Level  float64 `json:"level"`
+	Scale  float64 `json:"scale"`
+	Temp   float64 `json:"temp"`
+	Health string  `json:"health"`
+}
+
+//DeviceDetails ...
+type DeviceDetails struct {
+	Device struct {
+		Battery *Battery `json:"battery"`
+	} `json:"device"`
+}
+
+func (configs *configsModel) isBatteryCheckEnabled() bool {
+	return configs.minBatteryLevel > 0 || configs.maxBatteryTemperature > 0
+}
+
+func (battery *Battery) percentage() float64 {
+	if battery.Scale <= 0 {
+		return battery.Level
+	}
+	return battery.Level * 100 / battery.Scale
+}
+
+func checkBattery(configs configsModel, battery *Battery) error {
+	if battery == nil {
+		return fmt.Errorf("battery state unknown")
+	}
+	if containsString(badBatteryHealths, battery.Health) {
+		return fmt.Errorf("battery health: %s", battery.Health)
+	}
+	if configs.minBatteryLevel > 0 && battery.percentage() < float64(configs.minBatteryLevel) {
+		return fmt.Errorf("battery level %.0f%% lower than %d%%", battery.percentage(), configs.minBatteryLevel)
+	}
+	if configs.maxBatteryTemperature > 0 && battery.Temp > configs.maxBatteryTemperature {
+		return fmt.Errorf("battery temperature %g°C higher than %g°C", battery.Temp, configs.maxBatteryTemperature)
+	}
+	return nil
+}
+
+// recheckBattery verifies battery of already reserved device still satisfies requirements.
+func recheckBattery(configs configsModel, host stfHost, serial string) error {
+	battery, err := getDeviceBattery(configs, host, serial)
+	if err != nil {
+		return fmt.Errorf("could not get battery state, error: %s", err)
+	}
+	return checkBattery(configs, battery)
+}
+
+func getDeviceBattery(configs configsModel, host stfHost, serial string) (*Battery, error) {
+	req, err := http.NewRequest("GET", host.url+devicesEndpoint+"/"+serial, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
+	response, err := doRequest(req, configs.controlTimeout, host.accessToken)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body, error: %s", err)
+		}
+	}()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("request failed, status: %s", response.Status)
+	}
+	var details DeviceDetails
+	if err := json.NewDecoder(response.Body).Decode(&details); err != nil {
+		return nil, err
+	}
+	return details.Device.Battery, nil
+}
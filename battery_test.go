@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckBattery(t *testing.T) {
+	configs := configsModel{minBatteryLevel: 20, maxBatteryTemperature: 40}
+	require.NoError(t, checkBattery(configs, &Battery{Level: 50, Scale: 100, Temp: 30, Health: "good"}))
+	require.Error(t, checkBattery(configs, &Battery{Level: 5, Scale: 100, Temp: 30, Health: "good"}))
+	require.Error(t, checkBattery(configs, &Battery{Level: 50, Scale: 100, Temp: 45.5, Health: "good"}))
+	require.Error(t, checkBattery(configs, &Battery{Level: 50, Scale: 100, Temp: 30, Health: "overheat"}))
+	require.Error(t, checkBattery(configs, nil))
+}
+
+func TestBatteryPercentage(t *testing.T) {
+	require.Equal(t, 50.0, (&Battery{Level: 25, Scale: 50}).percentage())
+	require.Equal(t, 25.0, (&Battery{Level: 25}).percentage())
+}
+
+func TestBatteryRequirementsFilter(t *testing.T) {
+	configs := configsModel{deviceFilter: ".", minBatteryLevel: 20}
+	devices := `{"devices":[
+{"serial":"full","battery":{"level":100,"scale":100,"temp":25,"health":"good"}},
+{"serial":"empty","battery":{"level":5,"scale":100,"temp":25,"health":"good"}},
+{"serial":"overheat","battery":{"level":100,"scale":100,"temp":25,"health":"overheat"}},
+{"serial":"hot","battery":{"level":100,"scale":100,"temp":45,"health":"good"}}
+]}`
+	require.Equal(t, []string{"full", "hot"}, filterDevices(t, configs, devices))
+
+	configs.maxBatteryTemperature = 40
+	require.Equal(t, []string{"full"}, filterDevices(t, configs, devices))
+}
+
+func TestReserveDeviceReleasesDeviceWithLowBattery(t *testing.T) {
+	released := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == devicesEndpoint+"/serial":
+			_, _ = w.Write([]byte(`{"device":{"serial":"serial","battery":{"level":3,"scale":100,"temp":25,"health":"good"}}}`))
+		case r.Method == "DELETE" && r.URL.Path == userDevicesEndpoint+"/serial":
+			released = true
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	configs := configsModel{minBatteryLevel: 20, controlTimeout: time.Second}
+	_, err := reserveDevice(configs, deviceCandidate{serial: "serial", host: stfHost{url: server.URL, accessToken: "token"}, owned: true})
+	require.Error(t, err)
+	require.True(t, released)
+}
+
+func TestReserveDeviceReleasesDeviceWithUnknownBattery(t *testing.T) {
+	released := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == devicesEndpoint+"/serial":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == "DELETE" && r.URL.Path == userDevicesEndpoint+"/serial":
+			released = true
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	configs := configsModel{minBatteryLevel: 20, controlTimeout: time.Second}
+	_, err := reserveDevice(configs, deviceCandidate{serial: "serial", host: stfHost{url: server.URL, accessToken: "token"}, owned: true})
+	require.Error(t, err)
+	require.True(t, released)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sdcardPath = "/sdcard"
+
+type cleanupReport struct {
+	uninstalledPackages []string
+	clearedPackages     []string
+	removedFiles        []string
+}
+
+func (configs *configsModel) isCleanupEnabled() bool {
+	return len(configs.cleanupPackagePrefixes) > 0 || len(configs.cleanupClearDataPackages) > 0 || configs.cleanupSdcardPath != ""
+}
+
+func validateCleanupSdcardPath(sdcardCleanupPath string) error {
+	if sdcardCleanupPath == "" {
+		return nil
+	}
+	cleanPath := path.Clean(sdcardCleanupPath)
+	if cleanPath != sdcardCleanupPath || !strings.HasPrefix(cleanPath, sdcardPath+"/") {
+		return fmt.Errorf("cleanup path has to be normalized subdirectory of %s: %s", sdcardPath, sdcardCleanupPath)
+	}
+	return nil
+}
+
+func cleanupDevices(configs configsModel, devices []connectedDevice) {
+	reports := make([]cleanupReport, len(devices))
+	errs := make([]error, len(devices))
+	durations := make([]time.Duration, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device connectedDevice) {
+			defer wg.Done()
+			start := time.Now()
+			reports[i], errs[i] = cleanupDevice(configs, device)
+			durations[i] = time.Since(start)
+		}(i, device)
+	}
+	wg.Wait()
+
+	for i, device := range devices {
+		report := reports[i]
+		log.Infof("Device %s cleanup:", device.serial)
+		log.Printf("- uninstalled packages: %s", strings.Join(report.uninstalledPackages, ", "))
+		log.Printf("- cleared packages data: %s", strings.Join(report.clearedPackages, ", "))
+		log.Printf("- removed files: %s", strings.Join(report.removedFiles, ", "))
+		event := flowEvent{phase: "cleanup", serial: device.serial, host: device.host.url, duration: durations[i], err: errs[i]}
+		if errs[i] != nil {
+			event.logf("Device %s cleanup incomplete", device.serial)
+		} else {
+			event.logf("Device %s cleanup finished", device.serial)
+		}
+	}
+}
+
+func cleanupDevice(configs configsModel, device connectedDevice) (cleanupReport, error) {
+	var report cleanupReport
+	packagesOutput, err := runAdbOnDevice(device, "shell", "pm", "list", "packages")
+	if err != nil {
+		return report, fmt.Errorf("could not list packages, error: %s | output: %s", err, packagesOutput)
+	}
+	installedPackages := parsePackageList(packagesOutput)
+
+	for _, packageName := range filterPackagesByPrefixes(installedPackages, configs.cleanupPackagePrefixes) {
+		if output, err := runAdbOnDevice(device, "uninstall", packageName); err != nil || !strings.Contains(output, "Success") {
+			return report, fmt.Errorf("could not uninstall %s, error: %v | output: %s", packageName, err, output)
+		}
+		report.uninstalledPackages = append(report.uninstalledPackages, packageName)
+	}
+
+	for _, packageName := range configs.cleanupClearDataPackages {
+		if !containsString(installedPackages, packageName) || containsString(report.uninstalledPackages, packageName) {
+			continue
+		}
+		if output, err := runAdbOnDevice(device, "shell", "pm", "clear", packageName); err != nil || !strings.Contains(output, "Success") {
+			return report, fmt.Errorf("could not clear data of %s, error: %v | output: %s", packageName, err, output)
+		}
+		report.clearedPackages = append(report.clearedPackages, packageName)
+	}
+
+	if configs.cleanupSdcardPath != "" {
+		removedFiles, err := removeDirectoryContents(device, configs.cleanupSdcardPath)
+		report.removedFiles = removedFiles
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func filterPackagesByPrefixes(packages, prefixes []string) []string {
+	var matchingPackages []string
+	for _, packageName := range packages {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(packageName, strings.TrimSuffix(prefix, "*")) {
+				matchingPackages = append(matchingPackages, packageName)
+				break
+			}
+		}
+	}
+	return matchingPackages
+}
+
+func removeDirectoryContents(device connectedDevice, directory string) ([]string, error) {
+	output, err := runAdbOnDevice(device, "shell", "ls", "-A", shellQuote(directory))
+	if strings.Contains(output, "No such file or directory") {
+		// Nothing to remove if directory does not exist.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s, error: %s | output: %s", directory, err, output)
+	}
+	var removedFiles []string
+	for _, entry := range strings.Split(output, "\n") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		filePath := path.Join(directory, entry)
+		if output, err := runAdbOnDevice(device, "shell", "rm", "-rf", shellQuote(filePath)); err != nil {
+			return removedFiles, fmt.Errorf("could not remove %s, error: %s | output: %s", filePath, err, output)
+		}
+		removedFiles = append(removedFiles, filePath)
+	}
+	return removedFiles, nil
+}
+
+// shellQuote makes argument safe to be passed to device shell via adb shell, which joins all the arguments.
+func shellQuote(argument string) string {
+	return "'" + strings.Replace(argument, "'", `'\''`, -1) + "'"
+}
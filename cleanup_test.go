@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestIsCleanupEnabled(t *testing.T) {
+	require.False(t, (&configsModel{}).isCleanupEnabled())
+	require.True(t, (&configsModel{cleanupPackagePrefixes: []string{"com.example"}}).isCleanupEnabled())
+	require.True(t, (&configsModel{cleanupClearDataPackages: []string{"com.example.app"}}).isCleanupEnabled())
+	require.True(t, (&configsModel{cleanupSdcardPath: "/sdcard/test"}).isCleanupEnabled())
+}
+
+func TestValidateCleanupSdcardPath(t *testing.T) {
+	require.NoError(t, validateCleanupSdcardPath(""))
+	require.Error(t, validateCleanupSdcardPath("/sdcard"))
+	require.NoError(t, validateCleanupSdcardPath("/sdcard/test-results"))
+	require.Error(t, validateCleanupSdcardPath("/data/local/tmp"))
+	require.Error(t, validateCleanupSdcardPath("/sdcard/../data"))
+	require.Error(t, validateCleanupSdcardPath("/sdcardx"))
+	require.Error(t, validateCleanupSdcardPath("/sdcard/test/"))
+}
+
+func TestFilterPackagesByPrefixes(t *testing.T) {
+	packages := []string{"com.example.app", "com.example.app.test", "org.example", "com.android.settings"}
+	require.Equal(t, []string{"com.example.app", "com.example.app.test", "org.example"}, filterPackagesByPrefixes(packages, []string{"com.example.*", "org."}))
+	require.Nil(t, filterPackagesByPrefixes(packages, nil))
+}
+
+func TestShellQuote(t *testing.T) {
+	require.Equal(t, `'/sdcard/a b'`, shellQuote("/sdcard/a b"))
+	require.Equal(t, `'/sdcard/it'\''s'`, shellQuote("/sdcard/it's"))
+}
+
+func TestCleanupDevice(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	fake.on("adb -s device:7401 shell pm list packages", "package:com.example.app\npackage:com.example.app.test\npackage:com.android.chrome\n", nil)
+	fake.on("adb -s device:7401 uninstall", "Success", nil)
+	fake.on("adb -s device:7401 shell pm clear", "Success", nil)
+	fake.on("adb -s device:7401 shell ls", "screenshots\nlogs.txt\n", nil)
+	configs := configsModel{cleanupPackagePrefixes: []string{"com.example.*"}, cleanupClearDataPackages: []string{"com.android.chrome"}, cleanupSdcardPath: "/sdcard/test"}
+
+	report, err := cleanupDevice(configs, connectedDevice{serial: "device", remoteConnectURL: "device:7401"})
+	require.NoError(t, err)
+	require.Equal(t, cleanupReport{
+		uninstalledPackages: []string{"com.example.app", "com.example.app.test"},
+		clearedPackages:     []string{"com.android.chrome"},
+		removedFiles:        []string{"/sdcard/test/screenshots", "/sdcard/test/logs.txt"},
+	}, report)
+	require.Equal(t, []string{"adb -s device:7401 shell rm -rf '/sdcard/test/screenshots'", "adb -s device:7401 shell rm -rf '/sdcard/test/logs.txt'"},
+		fake.callsWithPrefix("adb -s device:7401 shell rm"))
+
+	fake.on("adb -s device:7401 shell ls", "ls: /sdcard/test: No such file or directory", errors.New("exit status 1"))
+	report, err = cleanupDevice(configs, connectedDevice{serial: "device", remoteConnectURL: "device:7401"})
+	require.NoError(t, err)
+	require.Empty(t, report.removedFiles)
+
+	fake.on("adb -s device:7401 shell ls", "error: closed", errors.New("exit status 1"))
+	_, err = cleanupDevice(configs, connectedDevice{serial: "device", remoteConnectURL: "device:7401"})
+	require.Error(t, err)
+
+	fake.on("adb -s device:7401 shell ls", "", nil)
+	fake.on("adb -s device:7401 uninstall", "Failure [DELETE_FAILED_INTERNAL_ERROR]", nil)
+	_, err = cleanupDevice(configs, connectedDevice{serial: "device", remoteConnectURL: "device:7401"})
+	require.Error(t, err)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//ListedDevice ...
+type ListedDevice struct {
+	Serial       string `json:"serial"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	SDK          string `json:"sdk"`
+	Owner        string `json:"owner"`
+}
+
+type cliInput struct {
+	name  string
+	usage string
+}
+
+// Step inputs which can be set with CLI flags, e.g. stf_host_url with -stf-host-url. Unset flags fall back to environment variables.
+var cliInputs = []cliInput{
+	{"config_file", "path to YAML config file"},
+	{"pool", "device pool from config file"},
+	{"stf_host_url", "STF host URLs separated by |"},
+	{"stf_access_token", "STF API access tokens separated by |"},
+	{"stf_fallback_host_urls", "fallback STF host URLs separated by |"},
+	{"stf_fallback_access_tokens", "fallback STF API access tokens separated by |"},
+	{"device_filter", "jq select expression devices have to match"},
+	{"device_number_limit", "maximum number of devices to connect"},
+	{"device_number_minimum", "minimum number of devices to connect"},
+	{"device_wait_timeout", "seconds to wait for enough free devices"},
+	{"device_wait_poll_interval", "seconds between device list requests while waiting"},
+	{"device_wait_events", "react to STF websocket device events while waiting (true/false)"},
+	{"stf_session_cookie", "STF web UI session cookies websocket is authenticated with, separated by |"},
+	{"remote_connect_host_rewrite", "remote connect host rewrite rules (regex => replacement), one per line"},
+	{"remote_connect_port_offset", "number added to remote connect ports"},
+	{"remote_connect_port_map", "remote connect port mappings (from:to) separated by |"},
+	{"adb_proxy_url", "HTTP CONNECT or SOCKS5 proxy URL ADB connects to devices through"},
+	{"adb_relay_idle_timeout", "seconds after which ADB relay exits once disconnected"},
+	{"min_sdk", "minimum API level"},
+	{"max_sdk", "maximum API level"},
+	{"manufacturers", "allowed manufacturers separated by |"},
+	{"model_regex", "regular expression device model has to match"},
+	{"abis", "allowed ABIs separated by |"},
+	{"min_display_width", "minimum display width in pixels"},
+	{"providers", "allowed STF providers separated by |"},
+	{"min_battery_level", "minimum battery level in percent"},
+	{"max_battery_temperature", "maximum battery temperature in degrees Celsius"},
+	{"include_serials", "serial patterns to include separated by |"},
+	{"exclude_serials", "serial patterns to exclude separated by |"},
+	{"reclaim_owned_devices", "reuse devices already owned by STF user (true/false)"},
+	{"release_stale_owned_devices_after_minutes", "release devices owned by STF user for longer than this"},
+	{"adb_key", "ADB private key"},
+	{"adb_key_pub", "ADB public key"},
+	{"stf_ca_certificate", "PEM CA certificates or path to them"},
+	{"stf_client_certificate", "PEM client certificate or path to it"},
+	{"stf_client_key", "PEM client key or path to it"},
+	{"stf_proxy_url", "proxy URL for STF requests"},
+	{"stf_no_proxy", "hosts STF requests bypass proxy for"},
+	{"stf_insecure_skip_verify", "skip STF certificate verification (true/false)"},
+	{"stf_connect_timeout", "STF connect timeout in seconds"},
+	{"stf_list_timeout", "STF device list timeout in seconds"},
+	{"stf_control_timeout", "STF device control timeout in seconds"},
+	{"stf_request_rate", "maximum average number of STF requests per second"},
+	{"quarantine_history_path", "path to device failure history"},
+	{"quarantine_failure_rate", "failure rate devices are quarantined at"},
+	{"quarantine_window", "number of recent attempts failure rate is computed from"},
+	{"quarantine_min_attempts", "minimum number of attempts before quarantine"},
+	{"quarantine_cooldown_hours", "hours before quarantined device is tried again"},
+	{"quarantine_mode", "quarantine mode: skip or deprioritize"},
+	{"lease_ledger_path", "path to local device lease ledger"},
+	{"lease_max_age_hours", "hours after which leases of other builds are released"},
+	{"apk_paths", "APKs to install on connected devices separated by |"},
+	{"test_apk_paths", "test APKs to install on connected devices separated by |"},
+	{"apk_install_options", "adb install options"},
+	{"cleanup_package_prefixes", "prefixes of packages to uninstall separated by |"},
+	{"cleanup_clear_data_packages", "packages to clear data of separated by |"},
+	{"cleanup_sdcard_path", "sdcard subdirectory to empty"},
+	{"collect_device_properties", "save device properties into deploy directory (true/false)"},
+	{"deploy_dir", "directory device properties are saved into"},
+	{"test_result_dir", "directory acquisition report is written into"},
+	{"output_format", "outputs export format: auto, envman, github, dotenv or json"},
+	{"dotenv_path", "path to dotenv file outputs are appended to"},
+	{"log_format", "log format: console or json"},
+	{"verbose_log", "enable debug logging (true/false)"},
+}
+
+type cliRunner func(configs configsModel, args []string, output io.Writer) int
+
+type cliCommand struct {
+	name        string
+	description string
+	// newRun defines flags specific to command and returns function running it with their parsed values.
+	newRun func(flagSet *flag.FlagSet) cliRunner
+}
+
+var cliCommands = []cliCommand{
+	{"list", "list present devices matching filter", withoutFlags(runListCommand)},
+	{"connect", "connect matching devices to ADB, same as the step", withoutFlags(runConnectCommand)},
+	{"release", "release given devices owned by STF user or all of them with -all", newReleaseCommand},
+	{"status", "list devices owned by STF user", withoutFlags(runStatusCommand)},
+	{relayCommandName, "relay local port to given address through ADB proxy, started by connect", withoutFlags(runRelayCommand)},
+}
+
+func withoutFlags(run cliRunner) func(flagSet *flag.FlagSet) cliRunner {
+	return func(flagSet *flag.FlagSet) cliRunner {
+		return run
+	}
+}
+
+// runCLI runs subcommand given in args and returns exit code.
+func runCLI(args []string, output io.Writer) int {
+	command, ok := findCLICommand(args[0])
+	if !ok {
+		printCLIUsage(output)
+		if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+			return 0
+		}
+		return 1
+	}
+
+	flagSet := flag.NewFlagSet(command.name, flag.ContinueOnError)
+	flagSet.SetOutput(output)
+	inputFlags := map[string]bool{}
+	for _, input := range cliInputs {
+		flagSet.String(cliFlagName(input.name), "", input.usage)
+		inputFlags[cliFlagName(input.name)] = true
+	}
+	run := command.newRun(flagSet)
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 1
+	}
+	var setErr error
+	flagSet.Visit(func(f *flag.Flag) {
+		if !inputFlags[f.Name] {
+			return
+		}
+		if err := os.Setenv(strings.Replace(f.Name, "-", "_", -1), f.Value.String()); err != nil && setErr == nil {
+			setErr = err
+		}
+	})
+	if setErr != nil {
+		log.Errorf("Could not apply flags, error: %s", setErr)
+		return 1
+	}
+
+	inputs, err := loadConfigFile(os.Getenv("config_file"), os.Getenv("pool"))
+	if err != nil {
+		log.Errorf("Could not load config file, error: %s", err)
+		return 1
+	}
+	return run(createConfigsModelFromEnvs(inputs), flagSet.Args(), redactingWriter{writer: output})
+}
+
+func findCLICommand(name string) (cliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+func cliFlagName(inputName string) string {
+	return strings.Replace(inputName, "_", "-", -1)
+}
+
+func printCLIUsage(output io.Writer) {
+	_, _ = fmt.Fprintf(output, "Usage: %s <command> [flags] [serials]\n\n", os.Args[0])
+	_, _ = fmt.Fprintln(output, "Without command runs as Bitrise step configured with environment variables.")
+	_, _ = fmt.Fprintln(output, "\nCommands:")
+	for _, command := range cliCommands {
+		_, _ = fmt.Fprintf(output, "  %-8s %s\n", command.name, command.description)
+	}
+	_, _ = fmt.Fprintln(output, "\nFlags (unset flags fall back to step input environment variables):")
+	for _, input := range cliInputs {
+		_, _ = fmt.Fprintf(output, "  -%s\n    \t%s (%s)\n", cliFlagName(input.name), input.usage, input.name)
+	}
+}
+
+// prepareCLIHosts sets up STF client and returns all configured hosts, including fallback ones.
+func prepareCLIHosts(configs configsModel) ([]stfHost, error) {
+	log.SetEnableDebugLog(configs.verboseLog)
+	registerSecrets(configs)
+	setLogFormat(configs.logFormat)
+	if err := configs.validate(); err != nil {
+		return nil, err
+	}
+	transport, err := createHTTPTransport(configs)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure STF HTTP client, error: %s", err)
+	}
+	client.Transport = transport
+	requestLimiter = newTokenBucket(configs.requestRate)
+	hosts, err := configs.getHosts()
+	if err != nil {
+		return nil, err
+	}
+	fallbackHosts, err := configs.getFallbackHosts()
+	if err != nil {
+		return nil, err
+	}
+	return append(hosts, fallbackHosts...), nil
+}
+
+func runConnectCommand(configs configsModel, args []string, output io.Writer) int {
+	if len(args) > 0 {
+		log.Errorf("Unexpected arguments: %s", strings.Join(args, " "))
+		return 1
+	}
+	return run(configs, output)
+}
+
+func runListCommand(configs configsModel, args []string, output io.Writer) int {
+	hosts, err := prepareCLIHosts(configs)
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "SERIAL\tMANUFACTURER\tMODEL\tSDK\tOWNER\tHOST")
+	exitCode := 0
+	for _, host := range hosts {
+		devices, err := listDevices(configs, host)
+		if err != nil {
+			log.Errorf("Could not list devices of %s, error: %s", host.url, err)
+			exitCode = 2
+			continue
+		}
+		for _, device := range devices {
+			_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", device.Serial, device.Manufacturer, device.Model, device.SDK, device.Owner, host.url)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		log.Errorf("Could not print devices, error: %s", err)
+		return 2
+	}
+	return exitCode
+}
+
+// listDevices returns present devices matching filter and serial lists, including the ones used by someone else.
+func listDevices(configs configsModel, host stfHost) ([]ListedDevice, error) {
+	output, err := queryDevices(configs, host, "[.devices[] | select(.present and ("+configs.getDeviceFilter()+")) | {serial, manufacturer, model, sdk, owner: (.owner.email // \"\")}]")
+	if err != nil {
+		return nil, err
+	}
+	var devices []ListedDevice
+	if err := json.Unmarshal([]byte(output), &devices); err != nil {
+		return nil, err
+	}
+	var serials []string
+	for _, device := range devices {
+		serials = append(serials, device.Serial)
+	}
+	serials = filterSerials(configs, serials)
+	var listedDevices []ListedDevice
+	for _, device := range devices {
+		if containsString(serials, device.Serial) {
+			listedDevices = append(listedDevices, device)
+		}
+	}
+	return listedDevices, nil
+}
+
+func runStatusCommand(configs configsModel, args []string, output io.Writer) int {
+	hosts, err := prepareCLIHosts(configs)
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "SERIAL\tREMOTE CONNECT URL\tOWNED SINCE\tHOST")
+	exitCode := 0
+	for _, host := range hosts {
+		devices, err := getOwnedDevices(configs, host)
+		if err != nil {
+			log.Errorf("Could not get owned devices of %s, error: %s", host.url, err)
+			exitCode = 2
+			continue
+		}
+		for _, device := range devices {
+			ownedSince := ""
+			if device.UsageChangedAt != nil {
+				ownedSince = device.UsageChangedAt.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", device.Serial, device.RemoteConnectURL, ownedSince, host.url)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		log.Errorf("Could not print devices, error: %s", err)
+		return 2
+	}
+	return exitCode
+}
+
+func newReleaseCommand(flagSet *flag.FlagSet) cliRunner {
+	all := flagSet.Bool("all", false, "release all devices owned by STF user")
+	return func(configs configsModel, serials []string, output io.Writer) int {
+		return runReleaseCommand(configs, serials, *all, output)
+	}
+}
+
+func runReleaseCommand(configs configsModel, serials []string, all bool, output io.Writer) int {
+	if all == (len(serials) > 0) {
+		log.Errorf("Either serials of devices to release or -all flag has to be given")
+		return 1
+	}
+	hosts, err := prepareCLIHosts(configs)
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	exitCode := 0
+	released := map[string]bool{}
+	for _, host := range hosts {
+		devices, err := getOwnedDevices(configs, host)
+		if err != nil {
+			log.Errorf("Could not get owned devices of %s, error: %s", host.url, err)
+			exitCode = 10
+			continue
+		}
+		for _, device := range devices {
+			if !all && !containsString(serials, device.Serial) {
+				continue
+			}
+			adbAddress := getOwnedDeviceAdbAddress(configs, host, device)
+			if err := releaseDevice(configs, connectedDevice{serial: device.Serial, host: host, remoteConnectURL: adbAddress, stfRemoteConnectURL: device.RemoteConnectURL}); err != nil {
+				log.Errorf("Could not release device %s from %s, error: %s", device.Serial, host.url, err)
+				exitCode = 10
+				continue
+			}
+			released[device.Serial] = true
+			_, _ = fmt.Fprintf(output, "Released %s from %s\n", device.Serial, host.url)
+		}
+	}
+	for _, serial := range serials {
+		if !released[serial] {
+			log.Errorf("Device %s is not owned by STF user", serial)
+			exitCode = 10
+		}
+	}
+	return exitCode
+}
+
+// getOwnedDeviceAdbAddress returns address ADB has been connected to device at by connect. It is recorded in lease ledger if any,
+// otherwise remote connect URL is rewritten the same way. Local relay address is known only from ledger, as relay port is random.
+func getOwnedDeviceAdbAddress(configs configsModel, host stfHost, device OwnedDevice) string {
+	if leasedAddress, ok := getLeasedAdbAddress(configs, host.url, device.Serial); ok {
+		return leasedAddress
+	}
+	if configs.adbProxyURL != "" {
+		log.Warnf("ADB relay address of device %s is unknown without lease ledger, ADB is not disconnected from it", device.Serial)
+		return ""
+	}
+	if device.RemoteConnectURL == "" {
+		return ""
+	}
+	adbAddress, err := rewriteRemoteConnectURL(configs, device.RemoteConnectURL)
+	if err != nil {
+		log.Warnf("Could not rewrite remote connect URL of device %s, error: %s", device.Serial, err)
+		return device.RemoteConnectURL
+	}
+	return adbAddress
+}
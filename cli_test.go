@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DroidsOnRoids/bitrise-step-openstf-connect/fakestf"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// preserveCLIEnvs restores environment variables which may be set by CLI flags.
+func preserveCLIEnvs(t *testing.T) func() {
+	values := map[string]string{"ENVMAN_ENVSTORE_PATH": os.Getenv("ENVMAN_ENVSTORE_PATH"), "BITRISE_IO": os.Getenv("BITRISE_IO")}
+	for _, input := range cliInputs {
+		values[input.name] = os.Getenv(input.name)
+	}
+	return func() {
+		for name, value := range values {
+			require.NoError(t, os.Setenv(name, value))
+		}
+	}
+}
+
+func newCLIServer() *fakestf.Server {
+	return fakestf.NewServer(e2eToken, e2eEmail,
+		fakestf.Device{Serial: "pixel", Present: true, Manufacturer: "Google", Model: "Pixel 3", SDK: "28"},
+		fakestf.Device{Serial: "galaxy", Present: true, Manufacturer: "Samsung", Model: "Galaxy S9", SDK: "28", Owner: &fakestf.Owner{Email: "other@example.com"}},
+		fakestf.Device{Serial: "nexus", Present: true, Manufacturer: "LGE", Model: "Nexus 5", SDK: "23"},
+		fakestf.Device{Serial: "offline", SDK: "28"},
+	)
+}
+
+func TestRunCLIList(t *testing.T) {
+	skipWithoutJQ(t)
+	defer preserveCLIEnvs(t)()
+	server := newCLIServer()
+	defer server.Close()
+
+	var output bytes.Buffer
+	require.Equal(t, 0, runCLI([]string{"list", "-stf-host-url", server.URL, "-stf-access-token", e2eToken, "-min-sdk", "28"}, &output))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Regexp(t, `^SERIAL\s+MANUFACTURER\s+MODEL\s+SDK\s+OWNER\s+HOST$`, lines[0])
+	require.Regexp(t, `^pixel\s+Google\s+Pixel 3\s+28\s+`+server.URL+`$`, lines[1])
+	require.Regexp(t, `^galaxy\s+Samsung\s+Galaxy S9\s+28\s+other@example.com\s+`+server.URL+`$`, lines[2])
+}
+
+func TestRunCLIStatusAndRelease(t *testing.T) {
+	defer preserveCLIEnvs(t)()
+	server := newCLIServer()
+	defer server.Close()
+	flags := []string{"-stf-host-url", server.URL, "-stf-access-token", e2eToken}
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newE2EConfigs()
+	require.NoError(t, addDeviceUnderControl(configs, host, "pixel"))
+	require.NoError(t, addDeviceUnderControl(configs, host, "nexus"))
+	_, err := getRemoteConnectURL(configs, host, "pixel")
+	require.NoError(t, err)
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+
+	var output bytes.Buffer
+	require.Equal(t, 0, runCLI(append([]string{"status"}, flags...), &output))
+	require.Contains(t, output.String(), "pixel   "+server.RemoteConnectURL("pixel"))
+	require.Contains(t, output.String(), "nexus")
+	require.NotContains(t, output.String(), "galaxy")
+
+	output.Reset()
+	require.Equal(t, 0, runCLI(append(append([]string{"release"}, flags...), "pixel"), &output))
+	require.Equal(t, "Released pixel from "+server.URL+"\n", output.String())
+	require.Equal(t, []string{"nexus"}, server.OwnedSerials(e2eEmail))
+	require.Len(t, fake.callsWithPrefix("adb disconnect"), 1)
+
+	require.Equal(t, 10, runCLI(append(append([]string{"release"}, flags...), "galaxy"), &output))
+	require.Equal(t, 1, runCLI(append([]string{"release"}, flags...), &output))
+	require.Equal(t, []string{"nexus"}, server.OwnedSerials(e2eEmail))
+	require.Equal(t, 1, runCLI(append(append([]string{"release", "-all"}, flags...), "nexus"), &output))
+	require.Equal(t, 0, runCLI(append([]string{"release", "-all"}, flags...), &output))
+	require.Empty(t, server.OwnedSerials(e2eEmail))
+	require.Len(t, fake.callsWithPrefix("adb disconnect"), 1)
+}
+
+func TestRunCLIReleaseDisconnectsLeasedRelayAddress(t *testing.T) {
+	defer preserveCLIEnvs(t)()
+	server := newCLIServer()
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "stf_cli_test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tempDir))
+	}()
+	ledgerPath := filepath.Join(tempDir, "leases.json")
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newE2EConfigs()
+	configs.leaseLedgerPath = ledgerPath
+	for _, serial := range []string{"pixel", "nexus"} {
+		require.NoError(t, addDeviceUnderControl(configs, host, serial))
+		_, err := getRemoteConnectURL(configs, host, serial)
+		require.NoError(t, err)
+	}
+	recordLease(configs, connectedDevice{serial: "pixel", host: host, remoteConnectURL: "127.0.0.1:40001"})
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	flags := []string{"-stf-host-url", server.URL, "-stf-access-token", e2eToken, "-adb-proxy-url", "http://proxy.example.com:3128"}
+
+	var output bytes.Buffer
+	require.Equal(t, 0, runCLI(append(append([]string{"release"}, flags...), "-lease-ledger-path", ledgerPath, "pixel"), &output))
+	require.Equal(t, []string{"adb disconnect 127.0.0.1:40001"}, fake.callsWithPrefix("adb disconnect"))
+	require.Empty(t, readTestLedger(t, ledgerPath).Leases)
+
+	require.Equal(t, 0, runCLI(append(append([]string{"release"}, flags...), "nexus"), &output))
+	require.Len(t, fake.callsWithPrefix("adb disconnect"), 1)
+	require.Empty(t, server.OwnedSerials(e2eEmail))
+}
+
+func TestRunReleaseCommandRequiresSerialsOrAll(t *testing.T) {
+	var output bytes.Buffer
+	require.Equal(t, 1, runReleaseCommand(configsModel{}, nil, false, &output))
+	require.Equal(t, 1, runReleaseCommand(configsModel{}, []string{"pixel"}, true, &output))
+}
+
+func TestRunCLIConnectWithoutEnvman(t *testing.T) {
+	defer preserveCLIEnvs(t)()
+	server := newCLIServer()
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	require.NoError(t, os.Setenv("ENVMAN_ENVSTORE_PATH", ""))
+	require.NoError(t, os.Setenv("BITRISE_IO", ""))
+
+	var output bytes.Buffer
+	require.Equal(t, 0, runCLI([]string{"connect", "-stf-host-url", server.URL, "-stf-access-token", e2eToken, "-device-number-limit", "1"}, &output))
+	require.Len(t, server.OwnedSerials(e2eEmail), 1)
+	require.Len(t, fake.callsWithPrefix("adb connect"), 1)
+	require.Empty(t, fake.callsWithPrefix("bitrise envman"))
+}
+
+func TestRunCLIConnectPrintsParseableJSON(t *testing.T) {
+	defer preserveCLIEnvs(t)()
+	server := newCLIServer()
+	defer server.Close()
+	_, restore := newRunCommandRunner(t)
+	defer restore()
+	tempDir, err := ioutil.TempDir("", "stf_cli_test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tempDir))
+	}()
+	stdout, err := os.Create(filepath.Join(tempDir, "stdout"))
+	require.NoError(t, err)
+	stderr, err := os.Create(filepath.Join(tempDir, "stderr"))
+	require.NoError(t, err)
+	originalStdout, originalStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr, logOutput = stdout, stderr, stdout
+	defer func() {
+		os.Stdout, os.Stderr, logOutput = originalStdout, originalStderr, originalStdout
+		setLogFormat(logFormatConsole)
+	}()
+
+	require.Equal(t, 0, runCLI([]string{"connect", "-stf-host-url", server.URL, "-stf-access-token", e2eToken, "-device-number-limit", "1",
+		"-output-format", outputFormatJSON, "-log-format", logFormatJSON, "-verbose-log", "true"}, os.Stdout))
+	require.NoError(t, stdout.Close())
+	require.NoError(t, stderr.Close())
+
+	content, err := ioutil.ReadFile(stdout.Name())
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 1)
+	var outputs map[string]string
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &outputs))
+	require.Equal(t, `["`+server.OwnedSerials(e2eEmail)[0]+`"]`, outputs["STF_DEVICE_SERIAL_LIST"])
+	require.Equal(t, server.URL, outputs["STF_HOST_URL_USED"])
+
+	content, err = ioutil.ReadFile(stderr.Name())
+	require.NoError(t, err)
+	logLines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.True(t, len(logLines) > 1)
+	for _, line := range logLines {
+		var entry jsonLogEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+	}
+}
+
+func TestRunCLIInvalidUsage(t *testing.T) {
+	defer preserveCLIEnvs(t)()
+	var output bytes.Buffer
+	require.Equal(t, 1, runCLI([]string{"reserve"}, &output))
+	require.Contains(t, output.String(), "Commands:")
+
+	output.Reset()
+	require.Equal(t, 0, runCLI([]string{"help"}, &output))
+	require.Contains(t, output.String(), "-stf-host-url")
+
+	require.Equal(t, 1, runCLI([]string{"list", "-unknown"}, &output))
+	require.Equal(t, 1, runCLI([]string{"connect", "-stf-host-url", "https://stf.example.com", "-stf-access-token", "token", "serial"}, &output))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type configFileModel struct {
+	STFHostURL              string  `yaml:"stf_host_url"`
+	STFAccessToken          string  `yaml:"stf_access_token"`
+	STFFallbackHostURLs     string  `yaml:"stf_fallback_host_urls"`
+	STFFallbackAccessTokens string  `yaml:"stf_fallback_access_tokens"`
+	CACertificate           string  `yaml:"stf_ca_certificate"`
+	ClientCertificate       string  `yaml:"stf_client_certificate"`
+	ClientKey               string  `yaml:"stf_client_key"`
+	ProxyURL                string  `yaml:"stf_proxy_url"`
+	NoProxy                 string  `yaml:"stf_no_proxy"`
+	InsecureSkipVerify      bool    `yaml:"stf_insecure_skip_verify"`
+	ConnectTimeout          int     `yaml:"stf_connect_timeout"`
+	ListTimeout             int     `yaml:"stf_list_timeout"`
+	ControlTimeout          int     `yaml:"stf_control_timeout"`
+	RequestRate             float64 `yaml:"stf_request_rate"`
+	SessionCookie           string  `yaml:"stf_session_cookie"`
+
+	Pools map[string]devicePoolModel `yaml:"pools"`
+}
+
+type devicePoolModel struct {
+	Filter string `yaml:"filter"`
+	Limit  int    `yaml:"limit"`
+	Min    int    `yaml:"min"`
+}
+
+// inputValues resolves step inputs from environment falling back to the values from config file.
+type inputValues map[string]string
+
+func (inputs inputValues) get(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return inputs[key]
+}
+
+func (inputs inputValues) getOrDefault(key, defaultValue string) string {
+	if value := inputs.get(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// loadConfigFile reads shared settings and selected pool from config file at path and returns them keyed by step input names.
+func loadConfigFile(path, pool string) (inputValues, error) {
+	if path == "" {
+		if pool != "" {
+			return nil, fmt.Errorf("pool %s selected but config file is not set", pool)
+		}
+		return inputValues{}, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file, error: %s", err)
+	}
+	configFile, err := parseConfigFile(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s, error: %s", path, err)
+	}
+	return configFile.toInputValues(pool)
+}
+
+// parseConfigFile decodes config file rejecting unknown keys, errors contain line numbers.
+func parseConfigFile(content []byte) (configFileModel, error) {
+	var configFile configFileModel
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&configFile); err != nil && err != io.EOF {
+		return configFile, err
+	}
+	return configFile, nil
+}
+
+func (configFile configFileModel) toInputValues(pool string) (inputValues, error) {
+	inputs := inputValues{
+		"stf_host_url":               configFile.STFHostURL,
+		"stf_access_token":           configFile.STFAccessToken,
+		"stf_fallback_host_urls":     configFile.STFFallbackHostURLs,
+		"stf_fallback_access_tokens": configFile.STFFallbackAccessTokens,
+		"stf_ca_certificate":         configFile.CACertificate,
+		"stf_client_certificate":     configFile.ClientCertificate,
+		"stf_client_key":             configFile.ClientKey,
+		"stf_proxy_url":              configFile.ProxyURL,
+		"stf_no_proxy":               configFile.NoProxy,
+		"stf_insecure_skip_verify":   formatNonZeroBool(configFile.InsecureSkipVerify),
+		"stf_connect_timeout":        formatNonZeroInt(configFile.ConnectTimeout),
+		"stf_list_timeout":           formatNonZeroInt(configFile.ListTimeout),
+		"stf_control_timeout":        formatNonZeroInt(configFile.ControlTimeout),
+		"stf_request_rate":           formatNonZeroFloat(configFile.RequestRate),
+		"stf_session_cookie":         configFile.SessionCookie,
+	}
+	if pool == "" {
+		return inputs, nil
+	}
+	devicePool, ok := configFile.Pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("pool %s not found in config file, available pools: %s", pool, strings.Join(configFile.getPoolNames(), ", "))
+	}
+	inputs["device_filter"] = devicePool.Filter
+	inputs["device_number_limit"] = formatNonZeroInt(devicePool.Limit)
+	inputs["device_number_minimum"] = formatNonZeroInt(devicePool.Min)
+	return inputs, nil
+}
+
+func (configFile configFileModel) getPoolNames() []string {
+	var names []string
+	for name := range configFile.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatNonZeroInt(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+func formatNonZeroFloat(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func formatNonZeroBool(value bool) string {
+	if !value {
+		return ""
+	}
+	return "true"
+}
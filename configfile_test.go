@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfigFile = `stf_host_url: https://stf.example.com
+stf_list_timeout: 120
+stf_ca_certificate: |
+  -----BEGIN CERTIFICATE-----
+  MIIB
+  -----END CERTIFICATE-----
+pools:
+  smoke:
+    filter: .sdk == "28"
+    limit: 2
+    min: 1
+  full-matrix:
+    filter: .
+`
+
+func TestParseConfigFilePool(t *testing.T) {
+	configFile, err := parseConfigFile([]byte(testConfigFile))
+	require.NoError(t, err)
+	inputs, err := configFile.toInputValues("smoke")
+	require.NoError(t, err)
+	require.Equal(t, "https://stf.example.com", inputs["stf_host_url"])
+	require.Equal(t, "120", inputs["stf_list_timeout"])
+	require.Equal(t, "", inputs["stf_connect_timeout"])
+	require.Equal(t, "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n", inputs["stf_ca_certificate"])
+	require.Equal(t, `.sdk == "28"`, inputs["device_filter"])
+	require.Equal(t, "2", inputs["device_number_limit"])
+	require.Equal(t, "1", inputs["device_number_minimum"])
+
+	inputs, err = configFile.toInputValues("")
+	require.NoError(t, err)
+	require.Equal(t, "", inputs["device_filter"])
+
+	_, err = configFile.toInputValues("nightly")
+	require.EqualError(t, err, "pool nightly not found in config file, available pools: full-matrix, smoke")
+}
+
+func TestParseConfigFileUnknownKeys(t *testing.T) {
+	_, err := parseConfigFile([]byte("stf_host_url: https://stf.example.com\nstf_token: token\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2")
+
+	_, err = parseConfigFile([]byte("pools:\n  smoke:\n    filter: .\n    max: 2\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 4")
+
+	_, err = parseConfigFile([]byte(""))
+	require.NoError(t, err)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_config_test")
+	require.NoError(t, err)
+	configPath := filepath.Join(tempDir, "stf.yml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(testConfigFile), 0644))
+
+	inputs, err := loadConfigFile(configPath, "smoke")
+	require.NoError(t, err)
+	require.Equal(t, "2", inputs["device_number_limit"])
+
+	_, err = loadConfigFile("", "smoke")
+	require.Error(t, err)
+	_, err = loadConfigFile(filepath.Join(tempDir, "missing.yml"), "")
+	require.Error(t, err)
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	require.NoError(t, os.Setenv("device_number_limit", "5"))
+	defer func() {
+		require.NoError(t, os.Unsetenv("device_number_limit"))
+	}()
+	inputs := inputValues{"device_filter": `.sdk == "28"`, "device_number_limit": "2", "device_number_minimum": "1", "stf_list_timeout": "120"}
+
+	configs := createConfigsModelFromEnvs(inputs)
+	require.Equal(t, `.sdk == "28"`, configs.deviceFilter)
+	require.Equal(t, 5, configs.deviceNumberLimit)
+	require.Equal(t, 1, configs.deviceNumberMinimum)
+	require.Equal(t, 120*time.Second, configs.listTimeout)
+	require.Equal(t, 30*time.Second, configs.controlTimeout)
+}
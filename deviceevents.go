@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Path of socket.io endpoint STF web UI receives device events from, Engine.IO protocol 3 over websocket.
+const stfWebsocketPath = "/socket.io/?EIO=3&transport=websocket"
+
+// Engine.IO pings are sent by client in protocol 3, this interval is used unless server tells otherwise.
+const defaultEngineIOPingInterval = 25 * time.Second
+
+type engineIOHandshake struct {
+	PingInterval int `json:"pingInterval"`
+}
+
+// getWebsocketURL derives websocket URL of STF host from its API URL.
+func getWebsocketURL(hostURL string) (string, error) {
+	parsedURL, err := url.Parse(hostURL)
+	if err != nil {
+		return "", err
+	}
+	switch parsedURL.Scheme {
+	case "http":
+		parsedURL.Scheme = "ws"
+	case "https":
+		parsedURL.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported STF host URL scheme: %s", parsedURL.Scheme)
+	}
+	return parsedURL.Scheme + "://" + parsedURL.Host + strings.TrimSuffix(parsedURL.Path, "/") + stfWebsocketPath, nil
+}
+
+// parseSocketIOEvent returns name of event carried by socket.io message or empty string if message is not an event.
+func parseSocketIOEvent(message string) string {
+	if !strings.HasPrefix(message, "42") {
+		return ""
+	}
+	// Namespace and acknowledgement ID may precede event array.
+	start := strings.Index(message, "[")
+	if start < 0 {
+		return ""
+	}
+	var event []json.RawMessage
+	if err := json.Unmarshal([]byte(message[start:]), &event); err != nil || len(event) == 0 {
+		return ""
+	}
+	var name string
+	if err := json.Unmarshal(event[0], &name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// isDeviceEvent tells if event may mean device became free, e.g. device.change sent when device is released.
+func isDeviceEvent(name string) bool {
+	return strings.HasPrefix(name, "device.")
+}
+
+// listenDeviceEvents notifies changes whenever STF host reports device presence or ownership change, until ctx is done.
+// STF authenticates websocket with web UI session cookie only, access tokens are not accepted.
+// Error is returned if events cannot be received, waiting then relies on polling only.
+func listenDeviceEvents(ctx context.Context, configs configsModel, host stfHost, changes chan<- struct{}) error {
+	if host.sessionCookie == "" {
+		return errors.New("STF session cookie is not set")
+	}
+	wsURL, err := getWebsocketURL(host.url)
+	if err != nil {
+		return err
+	}
+	proxyURL, err := getClientProxyURL(host.url)
+	if err != nil {
+		return err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, configs.connectTimeout)
+	conn, err := dialWebsocket(dialCtx, wsURL, http.Header{"Cookie": {host.sessionCookie}}, getClientTLSConfig(), proxyURL)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not connect to %s, error: %s", wsURL, err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+	log.Debugf("Listening to device events from %s", host.url)
+
+	for {
+		message, err := conn.readMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("device events connection lost, error: %s", err)
+		}
+		switch {
+		case strings.HasPrefix(message, "44"):
+			// socket.io error packet, sent e.g. when session cookie is not valid.
+			return fmt.Errorf("device events rejected, error: %s", message[2:])
+		case strings.HasPrefix(message, "0"):
+			go sendEngineIOPings(conn, parseEngineIOPingInterval(message[1:]), done)
+		case message == "2":
+			if err := conn.writeText("3"); err != nil {
+				return err
+			}
+		case isDeviceEvent(parseSocketIOEvent(message)):
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func parseEngineIOPingInterval(handshake string) time.Duration {
+	var parsed engineIOHandshake
+	if err := json.Unmarshal([]byte(handshake), &parsed); err != nil || parsed.PingInterval <= 0 {
+		return defaultEngineIOPingInterval
+	}
+	return time.Duration(parsed.PingInterval) * time.Millisecond
+}
+
+func sendEngineIOPings(conn *websocketConn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.writeText("2"); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func getClientTLSConfig() *tls.Config {
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		return transport.TLSClientConfig
+	}
+	return nil
+}
+
+// getClientProxyURL returns proxy STF client uses for requests to host URL or nil if requests are sent directly.
+func getClientProxyURL(hostURL string) (*url.URL, error) {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return nil, nil
+	}
+	req, err := http.NewRequest("GET", hostURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Proxy(req)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestGetWebsocketURL(t *testing.T) {
+	wsURL, err := getWebsocketURL("https://stf.example.com/")
+	require.NoError(t, err)
+	require.Equal(t, "wss://stf.example.com/socket.io/?EIO=3&transport=websocket", wsURL)
+
+	wsURL, err = getWebsocketURL("http://10.0.0.1:7100/stf")
+	require.NoError(t, err)
+	require.Equal(t, "ws://10.0.0.1:7100/stf/socket.io/?EIO=3&transport=websocket", wsURL)
+
+	_, err = getWebsocketURL("ftp://stf.example.com")
+	require.Error(t, err)
+}
+
+func TestParseSocketIOEvent(t *testing.T) {
+	require.Equal(t, "device.change", parseSocketIOEvent(`42["device.change",{"important":true,"data":{"serial":"a"}}]`))
+	require.Equal(t, "device.remove", parseSocketIOEvent(`42/stf,7["device.remove",{}]`))
+	require.Equal(t, "", parseSocketIOEvent(`40`))
+	require.Equal(t, "", parseSocketIOEvent(`3`))
+	require.Equal(t, "", parseSocketIOEvent(`42[1]`))
+	require.Equal(t, "", parseSocketIOEvent(`42[broken`))
+	require.True(t, isDeviceEvent("device.add"))
+	require.False(t, isDeviceEvent("user.settings.update"))
+}
+
+func TestParseEngineIOPingInterval(t *testing.T) {
+	require.Equal(t, 5*time.Second, parseEngineIOPingInterval(`{"sid":"x","pingInterval":5000}`))
+	require.Equal(t, defaultEngineIOPingInterval, parseEngineIOPingInterval(`{"sid":"x"}`))
+	require.Equal(t, defaultEngineIOPingInterval, parseEngineIOPingInterval(`broken`))
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/DroidsOnRoids/bitrise-step-openstf-connect/fakestf"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	e2eToken = "ci-token"
+	e2eEmail = "ci@example.com"
+)
+
+func newE2EConfigs() configsModel {
+	return configsModel{deviceFilter: ".", listTimeout: time.Second, controlTimeout: time.Second}
+}
+
+func freeDevice(serial string) fakestf.Device {
+	return fakestf.Device{Serial: serial, Present: true}
+}
+
+// connectCandidates connects devices in serial order with ADB commands faked and returns serials of connected ones.
+func connectCandidates(configs configsModel, candidates []deviceCandidate, count int) ([]string, *fakeCommandRunner) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].serial < candidates[j].serial })
+	devices, _ := connectDevices(configs, nil, nil, candidates, count)
+	return getDeviceSerials(devices), fake
+}
+
+func TestEndToEndReserveAndRelease(t *testing.T) {
+	skipWithoutJQ(t)
+	server := fakestf.NewServer(e2eToken, e2eEmail,
+		freeDevice("free"),
+		fakestf.Device{Serial: "busy", Present: true, Owner: &fakestf.Owner{Email: "other@example.com"}},
+		fakestf.Device{Serial: "absent"},
+	)
+	defer server.Close()
+	configs := newE2EConfigs()
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+
+	candidates, usedHosts, err := getCandidatesWithFallback(configs, []stfHost{host}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []stfHost{host}, usedHosts)
+	require.Equal(t, []deviceCandidate{{serial: "free", host: host}}, candidates)
+
+	remoteConnectURL, err := reserveDevice(configs, candidates[0])
+	require.NoError(t, err)
+	require.Equal(t, server.RemoteConnectURL("free"), remoteConnectURL)
+	require.Contains(t, remoteConnectURL, ":7401")
+	require.Equal(t, []string{"free"}, server.OwnedSerials(e2eEmail))
+
+	require.NoError(t, removeDeviceFromControl(configs, host, "free"))
+	require.Empty(t, server.OwnedSerials(e2eEmail))
+}
+
+func TestEndToEndAuthFailure(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("free"))
+	defer server.Close()
+
+	_, _, err := getCandidatesWithFallback(newE2EConfigs(), []stfHost{{url: server.URL, accessToken: "revoked"}}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "401")
+}
+
+func TestEndToEndDeviceTakenBetweenListAndReserve(t *testing.T) {
+	skipWithoutJQ(t)
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), freeDevice("b"))
+	defer server.Close()
+	server.TakeOnList("a", "other@example.com")
+	configs := newE2EConfigs()
+
+	candidates, _, err := getCandidatesWithFallback(configs, []stfHost{{url: server.URL, accessToken: e2eToken}}, nil)
+	require.NoError(t, err)
+	require.Len(t, candidates, 2)
+
+	serials, _ := connectCandidates(configs, candidates, 2)
+	require.Equal(t, []string{"b"}, serials)
+	require.Equal(t, []string{"b"}, server.OwnedSerials(e2eEmail))
+	device, _ := server.Device("a")
+	require.Equal(t, "other@example.com", device.Owner.Email)
+}
+
+func TestEndToEndSlowPrimaryFallsBack(t *testing.T) {
+	skipWithoutJQ(t)
+	primary := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("primary"))
+	defer primary.Close()
+	primary.SetDelay(500 * time.Millisecond)
+	fallback := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("fallback"))
+	defer fallback.Close()
+	configs := newE2EConfigs()
+	configs.listTimeout = 50 * time.Millisecond
+
+	fallbackHost := stfHost{url: fallback.URL, accessToken: e2eToken}
+	candidates, usedHosts, err := getCandidatesWithFallback(configs, []stfHost{{url: primary.URL, accessToken: e2eToken}}, []stfHost{fallbackHost})
+	require.NoError(t, err)
+	require.Equal(t, []stfHost{fallbackHost}, usedHosts)
+	serials, _ := connectCandidates(configs, candidates, 1)
+	require.Equal(t, []string{"fallback"}, serials)
+}
+
+func TestEndToEndServerErrors(t *testing.T) {
+	skipWithoutJQ(t)
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), freeDevice("b"), freeDevice("c"))
+	defer server.Close()
+	server.FailRequests("POST", "/api/v1/user/devices/b/remoteConnect", 502, 1)
+	server.FailRequests("POST", "/api/v1/user/devices", 503, 1)
+	configs := newE2EConfigs()
+
+	candidates, _, err := getCandidatesWithFallback(configs, []stfHost{{url: server.URL, accessToken: e2eToken}}, nil)
+	require.NoError(t, err)
+
+	// Reservation of "a" fails, "b" is reserved but remote connect fails and is released, "c" succeeds.
+	serials, fake := connectCandidates(configs, candidates, 1)
+	require.Equal(t, []string{"c"}, serials)
+	require.Contains(t, server.Requests(), "DELETE /api/v1/user/devices/b")
+	require.Equal(t, []string{"c"}, server.OwnedSerials(e2eEmail))
+	require.Equal(t, []string{"adb connect " + server.RemoteConnectURL("c")}, fake.callsWithPrefix("adb connect"))
+
+	server.FailRequests("GET", "/api/v1/devices", 500, -1)
+	_, _, err = getCandidatesWithFallback(configs, []stfHost{{url: server.URL, accessToken: e2eToken}}, nil)
+	require.Error(t, err)
+}
+
+func TestEndToEndReclaimOwnedDevice(t *testing.T) {
+	skipWithoutJQ(t)
+	now := time.Now()
+	server := fakestf.NewServer(e2eToken, e2eEmail,
+		fakestf.Device{Serial: "mine", Present: true, Owner: &fakestf.Owner{Email: e2eEmail}, UsageChangedAt: &now},
+	)
+	defer server.Close()
+	configs := newE2EConfigs()
+	configs.reclaimOwnedDevices = true
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+
+	candidates, _, err := getCandidatesWithFallback(configs, []stfHost{host}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []deviceCandidate{{serial: "mine", host: host, owned: true}}, candidates)
+
+	_, err = reserveDevice(configs, candidates[0])
+	require.NoError(t, err)
+	require.NotContains(t, server.Requests(), "POST /api/v1/user/devices")
+}
+
+func newRunConfigs(server *fakestf.Server) configsModel {
+	configs := newE2EConfigs()
+	configs.stfHostURL = server.URL
+	configs.stfAccessToken = e2eToken
+	configs.connectTimeout = time.Second
+	configs.outputFormat = outputFormatEnvman
+	return configs
+}
+
+func newRunCommandRunner(t *testing.T) (*fakeCommandRunner, func()) {
+	skipWithoutJQ(t)
+	fake, restore := useFakeCommandRunner()
+	fake.passThroughTool("jq")
+	return fake, restore
+}
+
+func TestRunConnectsDevices(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), freeDevice("b"), freeDevice("c"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	configs := newRunConfigs(server)
+	configs.deviceNumberLimit = 2
+
+	require.Equal(t, 0, run(configs, ioutil.Discard))
+	serials := server.OwnedSerials(e2eEmail)
+	require.Len(t, serials, 2)
+	require.Len(t, fake.callsWithPrefix("adb connect"), 2)
+	exports := fake.callsWithPrefix("bitrise envman add --key STF_DEVICE_SERIAL_LIST")
+	require.Len(t, exports, 1)
+	for _, serial := range serials {
+		require.Contains(t, exports[0], "\""+serial+"\"")
+	}
+	require.Equal(t, []string{"bitrise envman add --key STF_HOST_URL_USED --value " + server.URL},
+		fake.callsWithPrefix("bitrise envman add --key STF_HOST_URL_USED"))
+}
+
+func TestRunRetriesRateLimitedRequests(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), freeDevice("b"))
+	defer server.Close()
+	server.RateLimitRequests("GET", "/api/v1/devices", "0", 1)
+	server.RateLimitRequests("POST", "/api/v1/user/devices", "0", 2)
+	_, restore := newRunCommandRunner(t)
+	defer restore()
+	configs := newRunConfigs(server)
+	configs.requestRate = 50
+
+	require.Equal(t, 0, run(configs, ioutil.Discard))
+	require.Len(t, server.OwnedSerials(e2eEmail), 2)
+}
+
+func TestRunRewritesRemoteConnectURL(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	configs := newRunConfigs(server)
+	configs.remoteConnectHostRewrite = `^127\.0\.0\.1$ => localhost`
+	configs.remoteConnectPortOffset = 1000
+
+	require.Equal(t, 0, run(configs, ioutil.Discard))
+	require.Equal(t, []string{"adb connect localhost:8401"}, fake.callsWithPrefix("adb connect"))
+	require.Equal(t, []string{`bitrise envman add --key STF_DEVICE_ADDRESS_MAP --value {"a":{"remoteConnectUrl":"` + server.RemoteConnectURL("a") + `","adbAddress":"localhost:8401"}}`},
+		fake.callsWithPrefix("bitrise envman add --key STF_DEVICE_ADDRESS_MAP"))
+}
+
+func TestRunConnectsThroughAdbProxyRelay(t *testing.T) {
+	restoreRelay := useRelayHelperProcess(t)
+	defer restoreRelay()
+	echo := startEchoServer(t)
+	defer func() {
+		require.NoError(t, echo.Close())
+	}()
+	proxy := startConnectProxy("")
+	defer proxy.Close()
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	_, echoPort, err := net.SplitHostPort(echo.Addr().String())
+	require.NoError(t, err)
+	configs := newRunConfigs(server)
+	configs.connectTimeout = 5 * time.Second
+	configs.remoteConnectPortMap = "7401:" + echoPort
+	configs.adbProxyURL = proxy.URL
+	configs.adbRelayIdleTimeout = time.Second
+	defer func() {
+		require.NoError(t, os.Remove(getRelayLogPath(echo.Addr().String())))
+	}()
+
+	require.Equal(t, 0, run(configs, ioutil.Discard))
+	adbConnects := fake.callsWithPrefix("adb connect")
+	require.Len(t, adbConnects, 1)
+	relayAddress := strings.TrimPrefix(adbConnects[0], "adb connect ")
+	require.NotEqual(t, echo.Addr().String(), relayAddress)
+	conn, err := net.Dial("tcp", relayAddress)
+	require.NoError(t, err)
+	requireEcho(t, conn)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []string{`bitrise envman add --key STF_DEVICE_ADDRESS_MAP --value {"a":{"remoteConnectUrl":"` + server.RemoteConnectURL("a") + `","adbAddress":"` + relayAddress + `"}}`},
+		fake.callsWithPrefix("bitrise envman add --key STF_DEVICE_ADDRESS_MAP"))
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	require.Equal(t, 1, run(configsModel{}, ioutil.Discard))
+}
+
+func TestRunInvalidTransport(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"))
+	defer server.Close()
+	configs := newRunConfigs(server)
+	configs.caCertificate = "/nonexistent/ca.pem"
+	require.Equal(t, 9, run(configs, ioutil.Discard))
+}
+
+func TestRunMissingApk(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"))
+	defer server.Close()
+	configs := newRunConfigs(server)
+	configs.apkPaths = []string{"/nonexistent/app.apk"}
+	require.Equal(t, 7, run(configs, ioutil.Discard))
+}
+
+func TestRunNoMatchingDevices(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, fakestf.Device{Serial: "a"})
+	defer server.Close()
+	_, restore := newRunCommandRunner(t)
+	defer restore()
+	require.Equal(t, 2, run(newRunConfigs(server), ioutil.Discard))
+}
+
+func TestRunAdbConnectFails(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), freeDevice("b"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	fake.on("adb connect", "failed to connect to '127.0.0.1:7401': Connection refused", nil)
+	tempDir, err := ioutil.TempDir("", "stf_run_test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tempDir))
+	}()
+	configs := newRunConfigs(server)
+	configs.testResultDir = tempDir
+
+	require.Equal(t, 6, run(configs, ioutil.Discard))
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, testResultSubdirectory, junitReportFileName))
+	require.NoError(t, err)
+	require.Contains(t, string(content), `tests="2" failures="2"`)
+	require.Len(t, fake.callsWithPrefix("adb connect"), 2)
+	require.Empty(t, server.OwnedSerials(e2eEmail))
+	require.Equal(t, []string{"bitrise envman add --key STF_DEVICE_SERIAL_LIST --value []"},
+		fake.callsWithPrefix("bitrise envman add --key STF_DEVICE_SERIAL_LIST"))
+}
+
+func TestRunExportFails(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	fake.on("bitrise envman", "", errors.New("exit status 1"))
+	require.Equal(t, 5, run(newRunConfigs(server), ioutil.Discard))
+}
+
+func TestRunReplacesIncompatibleDeviceAndFailsOnInstallError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_run_test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tempDir))
+	}()
+	apkPath := filepath.Join(tempDir, "app.apk")
+	writeFakeApk(t, apkPath, buildBinaryManifest(true, "com.example.app"))
+
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("arm"), freeDevice("x86"))
+	defer server.Close()
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	armURL := server.Listener.Addr().(*net.TCPAddr).IP.String() + ":7401"
+	fake.on("adb -s "+armURL+" install", "Failure [INSTALL_FAILED_NO_MATCHING_ABIS]", nil)
+	fake.on("adb -s", "package:com.example.app", nil)
+	configs := newRunConfigs(server)
+	configs.apkPaths = []string{apkPath}
+	configs.deviceNumberLimit = 1
+
+	require.Equal(t, 0, run(configs, ioutil.Discard))
+	require.Equal(t, []string{"x86"}, server.OwnedSerials(e2eEmail))
+	require.NoError(t, removeDeviceFromControl(configs, stfHost{url: server.URL, accessToken: e2eToken}, "x86"))
+
+	fake.on("adb -s", "Failure [INSTALL_FAILED_VERSION_DOWNGRADE]", nil)
+	require.Equal(t, 8, run(configs, ioutil.Discard))
+}
+
+func TestRunNotEnoughDevices(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("a"), fakestf.Device{Serial: "b", Present: true, Owner: &fakestf.Owner{Email: "other@example.com"}})
+	defer server.Close()
+	_, restore := newRunCommandRunner(t)
+	defer restore()
+	configs := newRunConfigs(server)
+	configs.deviceNumberMinimum = 2
+	require.Equal(t, 6, run(configs, ioutil.Discard))
+}
+
+func TestRunNeverLeaksSecrets(t *testing.T) {
+	const token = "leaky-secret-token"
+	tempDir, err := ioutil.TempDir("", "stf_redact_test")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tempDir))
+	}()
+	var logs bytes.Buffer
+	logOutput = &logs
+	defer func() {
+		logOutput = os.Stdout
+		setLogFormat(logFormatConsole)
+	}()
+
+	server := fakestf.NewServer(token, e2eEmail, freeDevice("a"), freeDevice("b"))
+	defer server.Close()
+	server.EchoAuthorization(true)
+	server.FailRequests("POST", "/api/v1/user/devices/a/remoteConnect", 500, 1)
+	fake, restore := newRunCommandRunner(t)
+	defer restore()
+	fake.on("adb connect", "connected, token "+token, nil)
+	fake.on("adb -s", "[ro.build.fingerprint]: ["+token+"]", nil)
+
+	configs := newRunConfigs(server)
+	configs.stfAccessToken = token
+	configs.verboseLog = true
+	configs.collectDeviceProperties = true
+	configs.deployDir = tempDir
+	configs.outputFormat = outputFormatDotenv
+	configs.dotenvPath = filepath.Join(tempDir, "outputs.env")
+	for _, logFormat := range []string{logFormatConsole, logFormatJSON} {
+		configs.logFormat = logFormat
+		require.Equal(t, 0, run(configs, ioutil.Discard))
+		require.NoError(t, removeDeviceFromControl(configs, stfHost{url: server.URL, accessToken: token}, "b"))
+		server.FailRequests("POST", "/api/v1/user/devices/a/remoteConnect", 500, 1)
+	}
+
+	require.Contains(t, logs.String(), "Authorization: Bearer [REDACTED]")
+	require.NotContains(t, logs.String(), token)
+	files, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.True(t, len(files) > 2)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(tempDir, file.Name()))
+		require.NoError(t, err)
+		require.NotContains(t, string(content), token, file.Name())
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outputFormatAuto   = "auto"
+	outputFormatEnvman = "envman"
+	outputFormatGitHub = "github"
+	outputFormatDotenv = "dotenv"
+	outputFormatJSON   = "json"
+)
+
+var outputFormats = []string{outputFormatAuto, outputFormatEnvman, outputFormatGitHub, outputFormatDotenv, outputFormatJSON}
+
+// outputExporter makes step outputs available to the subsequent steps of CI system.
+type outputExporter interface {
+	export(key, value string) error
+	// flush is called once after all the outputs are exported.
+	flush() error
+}
+
+func validateOutputFormat(configs configsModel) error {
+	if configs.outputFormat != "" && !containsString(outputFormats, configs.outputFormat) {
+		return fmt.Errorf("unsupported output format: %s, supported formats: %s", configs.outputFormat, strings.Join(outputFormats, ", "))
+	}
+	return nil
+}
+
+// detectOutputFormat picks output format native to CI system the step is running on.
+func detectOutputFormat() string {
+	switch {
+	case os.Getenv("ENVMAN_ENVSTORE_PATH") != "" || os.Getenv("BITRISE_IO") != "":
+		return outputFormatEnvman
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return outputFormatGitHub
+	case os.Getenv("GITLAB_CI") != "":
+		return outputFormatDotenv
+	}
+	return outputFormatJSON
+}
+
+// getOutputFormat returns configured output format, auto one resolved to the format native to CI system.
+func (configs configsModel) getOutputFormat() string {
+	if configs.outputFormat == "" || configs.outputFormat == outputFormatAuto {
+		return detectOutputFormat()
+	}
+	return configs.outputFormat
+}
+
+// newOutputExporter creates exporter of configured format, which masks secrets in exported values.
+// JSON outputs are printed to output.
+func newOutputExporter(configs configsModel, output io.Writer) (outputExporter, error) {
+	exporter, err := newFormatExporter(configs, configs.getOutputFormat(), output)
+	if err != nil {
+		return nil, err
+	}
+	return redactingExporter{exporter: exporter}, nil
+}
+
+func newFormatExporter(configs configsModel, format string, output io.Writer) (outputExporter, error) {
+	switch format {
+	case outputFormatEnvman:
+		return envmanExporter{}, nil
+	case outputFormatGitHub:
+		outputPath, envPath := os.Getenv("GITHUB_OUTPUT"), os.Getenv("GITHUB_ENV")
+		if outputPath == "" && envPath == "" {
+			return nil, errors.New("neither GITHUB_OUTPUT nor GITHUB_ENV is set")
+		}
+		return gitHubExporter{outputPath: outputPath, envPath: envPath}, nil
+	case outputFormatDotenv:
+		return dotenvExporter{path: configs.dotenvPath}, nil
+	case outputFormatJSON:
+		return &jsonExporter{output: output, values: map[string]string{}}, nil
+	}
+	return nil, fmt.Errorf("unsupported output format: %s", format)
+}
+
+type envmanExporter struct{}
+
+func (envmanExporter) export(key, value string) error {
+	return runner.run("bitrise", "envman", "add", "--key", key, "--value", value)
+}
+
+func (envmanExporter) flush() error {
+	return nil
+}
+
+// gitHubExporter sets both step outputs and environment variables of GitHub Actions job.
+type gitHubExporter struct {
+	outputPath string
+	envPath    string
+}
+
+func (exporter gitHubExporter) export(key, value string) error {
+	entry := formatGitHubEntry(key, value, strconv.FormatInt(time.Now().UnixNano(), 36))
+	for _, path := range []string{exporter.outputPath, exporter.envPath} {
+		if path == "" {
+			continue
+		}
+		if err := appendToFile(path, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gitHubExporter) flush() error {
+	return nil
+}
+
+// formatGitHubEntry uses heredoc syntax for multiline values as described in GitHub Actions workflow commands documentation.
+func formatGitHubEntry(key, value, delimiterSuffix string) string {
+	if !strings.ContainsAny(value, "\r\n") {
+		return key + "=" + value + "\n"
+	}
+	delimiter := "STF_EOF_" + delimiterSuffix
+	return key + "<<" + delimiter + "\n" + value + "\n" + delimiter + "\n"
+}
+
+const defaultDotenvPath = "stf-connect.env"
+
+// dotenvExporter appends outputs to dotenv file e.g. GitLab CI dotenv report.
+type dotenvExporter struct {
+	path string
+}
+
+func (exporter dotenvExporter) export(key, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("multiline value of %s cannot be exported to dotenv file", key)
+	}
+	return appendToFile(exporter.path, key+"="+value+"\n")
+}
+
+func (dotenvExporter) flush() error {
+	return nil
+}
+
+// jsonExporter prints all outputs as single JSON object in one line.
+type jsonExporter struct {
+	output io.Writer
+	values map[string]string
+}
+
+func (exporter *jsonExporter) export(key, value string) error {
+	exporter.values[key] = value
+	return nil
+}
+
+func (exporter *jsonExporter) flush() error {
+	body, err := json.Marshal(exporter.values)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(exporter.output, string(body))
+	return err
+}
+
+func appendToFile(path, content string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func exportArray(exporter outputExporter, key string, values []string) error {
+	body, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return exporter.export(key, string(body))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateOutputFormat(t *testing.T) {
+	require.NoError(t, validateOutputFormat(configsModel{}))
+	require.NoError(t, validateOutputFormat(configsModel{outputFormat: outputFormatGitHub}))
+	require.Error(t, validateOutputFormat(configsModel{outputFormat: "xml"}))
+}
+
+func TestDetectOutputFormat(t *testing.T) {
+	envs := []string{"ENVMAN_ENVSTORE_PATH", "BITRISE_IO", "GITHUB_ACTIONS", "GITLAB_CI"}
+	values := map[string]string{}
+	for _, env := range envs {
+		values[env] = os.Getenv(env)
+		require.NoError(t, os.Unsetenv(env))
+	}
+	defer func() {
+		for env, value := range values {
+			require.NoError(t, os.Setenv(env, value))
+		}
+	}()
+
+	require.Equal(t, outputFormatJSON, detectOutputFormat())
+	require.NoError(t, os.Setenv("GITLAB_CI", "true"))
+	require.Equal(t, outputFormatDotenv, detectOutputFormat())
+	require.NoError(t, os.Setenv("GITHUB_ACTIONS", "true"))
+	require.Equal(t, outputFormatGitHub, detectOutputFormat())
+	require.NoError(t, os.Setenv("ENVMAN_ENVSTORE_PATH", "/tmp/envstore.yml"))
+	require.Equal(t, outputFormatEnvman, detectOutputFormat())
+}
+
+func TestEnvmanExporter(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	require.NoError(t, exportArray(envmanExporter{}, "STF_DEVICE_SERIAL_LIST", []string{"a", "b"}))
+	require.Equal(t, []string{`bitrise envman add --key STF_DEVICE_SERIAL_LIST --value ["a","b"]`}, fake.callsWithPrefix("bitrise"))
+}
+
+func TestGitHubExporter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_export_test")
+	require.NoError(t, err)
+	exporter := gitHubExporter{outputPath: filepath.Join(tempDir, "output"), envPath: filepath.Join(tempDir, "env")}
+
+	require.NoError(t, exporter.export("STF_HOST_URL_USED", "https://stf.example.com"))
+	require.NoError(t, exporter.export("STF_DEVICE_SERIAL_LIST", `["a"]`))
+	for _, path := range []string{exporter.outputPath, exporter.envPath} {
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "STF_HOST_URL_USED=https://stf.example.com\nSTF_DEVICE_SERIAL_LIST=[\"a\"]\n", string(content))
+	}
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestFormatGitHubEntry(t *testing.T) {
+	require.Equal(t, "KEY=value\n", formatGitHubEntry("KEY", "value", "1"))
+	require.Equal(t, "KEY<<STF_EOF_1\nfirst\nsecond\nSTF_EOF_1\n", formatGitHubEntry("KEY", "first\nsecond", "1"))
+}
+
+func TestDotenvExporter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_export_test")
+	require.NoError(t, err)
+	exporter := dotenvExporter{path: filepath.Join(tempDir, "stf.env")}
+
+	require.NoError(t, exporter.export("STF_HOST_URL_USED", "https://stf.example.com"))
+	require.NoError(t, exporter.export("STF_DEVICE_HOST_MAP", `{"a":"https://stf.example.com"}`))
+	require.Error(t, exporter.export("MULTILINE", "first\nsecond"))
+	content, err := ioutil.ReadFile(exporter.path)
+	require.NoError(t, err)
+	require.Equal(t, "STF_HOST_URL_USED=https://stf.example.com\nSTF_DEVICE_HOST_MAP={\"a\":\"https://stf.example.com\"}\n", string(content))
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestJSONExporter(t *testing.T) {
+	var output bytes.Buffer
+	exporter := &jsonExporter{output: &output, values: map[string]string{}}
+	require.NoError(t, exporter.export("STF_HOST_URL_USED", "https://stf.example.com"))
+	require.NoError(t, exportArray(exporter, "STF_DEVICE_SERIAL_LIST", []string{"a"}))
+	require.Empty(t, output.String())
+
+	require.NoError(t, exporter.flush())
+	require.Equal(t, 1, strings.Count(output.String(), "\n"))
+	require.JSONEq(t, `{"STF_HOST_URL_USED":"https://stf.example.com","STF_DEVICE_SERIAL_LIST":"[\"a\"]"}`, output.String())
+}
@@ -0,0 +1,209 @@
+package fakestf
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+)
+
+// SocketIOPath is where fake STF accepts websocket connections receiving device events, like STF web UI does.
+const SocketIOPath = "/socket.io/"
+
+// Cookie holding web UI session, signed by accompanying cookie with ".sig" suffix. STF websocket accepts no other credentials.
+const sessionCookieName = "ssid"
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Engine.IO open packet sent to every new events client, followed by socket.io connect or error packet.
+const engineIOOpen = `0{"sid":"fakestf","upgrades":[],"pingInterval":25000,"pingTimeout":60000}`
+const socketIOConnect = "40"
+const socketIOUnauthorized = `44"Missing authorization token"`
+
+type eventsClient struct {
+	messages chan string
+}
+
+// SessionCookie returns Cookie header value of web UI session of user with email.
+func (server *Server) SessionCookie(email string) string {
+	session := "session-" + email
+	return sessionCookieName + "=" + session + "; " + sessionCookieName + ".sig=" + signSession(session)
+}
+
+func signSession(session string) string {
+	hash := sha1.Sum([]byte("fakestf:" + session))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// sessionUser returns user of signed session cookie sent with request, like STF websocket auth middleware does.
+func (server *Server) sessionUser(r *http.Request) (Owner, bool) {
+	session, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return Owner{}, false
+	}
+	signature, err := r.Cookie(sessionCookieName + ".sig")
+	if err != nil || signature.Value != signSession(session.Value) {
+		return Owner{}, false
+	}
+	user, ok := server.sessions[session.Value]
+	return user, ok
+}
+
+// ReleaseDevice releases device from whoever owns it, like its owner or STF admin would do from web UI.
+func (server *Server) ReleaseDevice(serial string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if device := server.findDevice(serial); device != nil {
+		device.Owner = nil
+		delete(server.remoteConnects, serial)
+		server.broadcastDeviceChange(device)
+	}
+}
+
+// broadcastDeviceChange sends device.change event to all events clients, server mutex has to be held.
+func (server *Server) broadcastDeviceChange(device *Device) {
+	event, err := json.Marshal([]interface{}{"device.change", map[string]interface{}{"important": true, "data": device}})
+	if err != nil {
+		return
+	}
+	for client := range server.eventsClients {
+		select {
+		case client.messages <- "42" + string(event):
+		default:
+		}
+	}
+}
+
+func (server *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	if f := server.takeFailure(r); f != nil {
+		server.mutex.Unlock()
+		writeJSON(w, f.status, map[string]interface{}{"success": false, "description": http.StatusText(f.status)})
+		return
+	}
+	_, authorized := server.sessionUser(r)
+	server.mutex.Unlock()
+	key := r.Header.Get("Sec-WebSocket-Key")
+	hijacker, ok := w.(http.Hijacker)
+	if r.Header.Get("Upgrade") != "websocket" || key == "" || !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "description": "Bad Request"})
+		return
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	_, err = buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err != nil || buffer.Flush() != nil {
+		_ = conn.Close()
+		return
+	}
+
+	// Like socket.io, authorization fails after connection is established.
+	if !authorized {
+		_ = writeWebsocketFrame(conn, 0x1, []byte(engineIOOpen))
+		_ = writeWebsocketFrame(conn, 0x1, []byte(socketIOUnauthorized))
+		_ = conn.Close()
+		return
+	}
+	client := &eventsClient{messages: make(chan string, 16)}
+	client.messages <- engineIOOpen
+	client.messages <- socketIOConnect
+	server.mutex.Lock()
+	server.eventsClients[client] = struct{}{}
+	server.mutex.Unlock()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.eventsClients, client)
+		server.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	closed := make(chan struct{})
+	go server.readEventsClient(conn, buffer.Reader, client, closed)
+	for {
+		select {
+		case message := <-client.messages:
+			if err := writeWebsocketFrame(conn, 0x1, []byte(message)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// readEventsClient answers Engine.IO pings until client disconnects.
+func (server *Server) readEventsClient(conn net.Conn, reader *bufio.Reader, client *eventsClient, closed chan<- struct{}) {
+	defer close(closed)
+	for {
+		opcode, payload, err := readWebsocketFrame(reader)
+		if err != nil || opcode == 0x8 {
+			return
+		}
+		if opcode == 0x1 && string(payload) == "2" {
+			select {
+			case client.messages <- "3":
+			default:
+			}
+		}
+	}
+}
+
+func readWebsocketFrame(reader io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	var mask [4]byte
+	if header[1]&0x80 != 0 {
+		if _, err := io.ReadFull(reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// writeWebsocketFrame writes single final unmasked frame, as servers do.
+func writeWebsocketFrame(writer io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	_, err := writer.Write(append(frame, payload...))
+	return err
+}
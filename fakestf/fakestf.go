@@ -0,0 +1,390 @@
+// Package fakestf provides in-process fake of Device Farmer/Open STF API for tests.
+package fakestf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	devicesPath     = "/api/v1/devices"
+	userPath        = "/api/v1/user"
+	userDevicesPath = "/api/v1/user/devices"
+
+	remoteConnectBasePort = 7401
+)
+
+// Owner is STF user owning a device.
+type Owner struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// Battery is battery state reported by STF.
+type Battery struct {
+	Level  float64 `json:"level"`
+	Scale  float64 `json:"scale"`
+	Temp   float64 `json:"temp"`
+	Health string  `json:"health"`
+}
+
+// Display is display info reported by STF.
+type Display struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Provider is STF provider the device is attached to.
+type Provider struct {
+	Name string `json:"name"`
+}
+
+// Device is the device state served by the fake.
+type Device struct {
+	Serial         string     `json:"serial"`
+	Present        bool       `json:"present"`
+	Owner          *Owner     `json:"owner"`
+	SDK            string     `json:"sdk,omitempty"`
+	Manufacturer   string     `json:"manufacturer,omitempty"`
+	Model          string     `json:"model,omitempty"`
+	ABI            string     `json:"abi,omitempty"`
+	Display        *Display   `json:"display,omitempty"`
+	Provider       *Provider  `json:"provider,omitempty"`
+	Battery        *Battery   `json:"battery,omitempty"`
+	UsageChangedAt *time.Time `json:"usageChangedAt,omitempty"`
+	// RemoteConnectURL is filled in by the server while device is remotely connected.
+	RemoteConnectURL string `json:"remoteConnectUrl,omitempty"`
+}
+
+type failure struct {
+	method     string
+	pathPrefix string
+	status     int
+	retryAfter string
+	remaining  int
+}
+
+// Server is fake STF instance. Its scenario can be changed at any time, also while requests are being served.
+type Server struct {
+	*httptest.Server
+
+	mutex          sync.Mutex
+	users          map[string]Owner
+	devices        []*Device
+	remoteConnects map[string]string
+	delay          time.Duration
+	failures       []*failure
+	takenOnList    map[string]Owner
+	requests       []string
+	echoAuth       bool
+	eventsClients  map[*eventsClient]struct{}
+	sessions       map[string]Owner
+}
+
+// NewServer starts fake STF with given devices and single user authenticated by token,
+// or by session cookie returned from SessionCookie on websocket.
+func NewServer(token, email string, devices ...Device) *Server {
+	server := &Server{
+		users:          map[string]Owner{token: {Email: email, Name: email}},
+		remoteConnects: map[string]string{},
+		takenOnList:    map[string]Owner{},
+		eventsClients:  map[*eventsClient]struct{}{},
+		sessions:       map[string]Owner{"session-" + email: {Email: email, Name: email}},
+	}
+	for i := range devices {
+		device := devices[i]
+		server.devices = append(server.devices, &device)
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// AddUser registers another user authenticated by token.
+func (server *Server) AddUser(token, email string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.users[token] = Owner{Email: email, Name: email}
+}
+
+// SetDelay delays every response by given duration.
+func (server *Server) SetDelay(delay time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.delay = delay
+}
+
+// FailRequests makes next count requests matching method and path prefix fail with given status. Negative count means forever.
+func (server *Server) FailRequests(method, pathPrefix string, status, count int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.failures = append(server.failures, &failure{method: method, pathPrefix: pathPrefix, status: status, remaining: count})
+}
+
+// RateLimitRequests makes next count requests matching method and path prefix fail with 429 Too Many Requests
+// and given Retry-After header, which is omitted if empty.
+func (server *Server) RateLimitRequests(method, pathPrefix, retryAfter string, count int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.failures = append(server.failures, &failure{
+		method:     method,
+		pathPrefix: pathPrefix,
+		status:     http.StatusTooManyRequests,
+		retryAfter: retryAfter,
+		remaining:  count,
+	})
+}
+
+// EchoAuthorization makes failed requests echo received Authorization header in response description,
+// like some misconfigured proxies do.
+func (server *Server) EchoAuthorization(echo bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.echoAuth = echo
+}
+
+// TakeOnList simulates race, device is taken by another user right after it is listed.
+func (server *Server) TakeOnList(serial, email string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.takenOnList[serial] = Owner{Email: email, Name: email}
+}
+
+// Device returns copy of device state.
+func (server *Server) Device(serial string) (Device, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if device := server.findDevice(serial); device != nil {
+		return *device, true
+	}
+	return Device{}, false
+}
+
+// OwnedSerials returns serials of devices owned by user.
+func (server *Server) OwnedSerials(email string) []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	var serials []string
+	for _, device := range server.devices {
+		if device.Owner != nil && device.Owner.Email == email {
+			serials = append(serials, device.Serial)
+		}
+	}
+	return serials
+}
+
+// RemoteConnectURL returns address the device is currently exposed at or empty string if not remotely connected.
+func (server *Server) RemoteConnectURL(serial string) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.remoteConnects[serial]
+}
+
+// Requests returns all the served requests as "METHOD path" strings.
+func (server *Server) Requests() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string(nil), server.requests...)
+}
+
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	server.requests = append(server.requests, r.Method+" "+r.URL.Path)
+	delay := server.delay
+	server.mutex.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if r.URL.Path == SocketIOPath {
+		server.serveEvents(w, r)
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if f := server.takeFailure(r); f != nil {
+		description := http.StatusText(f.status)
+		if server.echoAuth {
+			description += ", Authorization: " + r.Header.Get("Authorization")
+		}
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeJSON(w, f.status, map[string]interface{}{"success": false, "description": description})
+		return
+	}
+	user, ok := server.users[bearerToken(r)]
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "description": "Bad Credentials"})
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case r.Method == "GET" && path == devicesPath:
+		server.listDevices(w)
+	case r.Method == "GET" && strings.HasPrefix(path, devicesPath+"/"):
+		server.getDevice(w, strings.TrimPrefix(path, devicesPath+"/"))
+	case r.Method == "GET" && path == userPath:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "user": user})
+	case r.Method == "GET" && path == userDevicesPath:
+		server.listUserDevices(w, user)
+	case r.Method == "POST" && path == userDevicesPath:
+		server.addUserDevice(w, r, user)
+	case r.Method == "DELETE" && strings.HasPrefix(path, userDevicesPath+"/") && strings.HasSuffix(path, "/remoteConnect"):
+		server.remoteDisconnect(w, userDeviceSerial(path), user)
+	case r.Method == "POST" && strings.HasPrefix(path, userDevicesPath+"/") && strings.HasSuffix(path, "/remoteConnect"):
+		server.remoteConnect(w, userDeviceSerial(path), user)
+	case r.Method == "DELETE" && strings.HasPrefix(path, userDevicesPath+"/"):
+		server.deleteUserDevice(w, userDeviceSerial(path), user)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "description": "Not Found"})
+	}
+}
+
+func (server *Server) takeFailure(r *http.Request) *failure {
+	for _, f := range server.failures {
+		if f.remaining == 0 || f.method != r.Method || !strings.HasPrefix(r.URL.Path, f.pathPrefix) {
+			continue
+		}
+		if f.remaining > 0 {
+			f.remaining--
+		}
+		return f
+	}
+	return nil
+}
+
+func (server *Server) findDevice(serial string) *Device {
+	for _, device := range server.devices {
+		if device.Serial == serial {
+			return device
+		}
+	}
+	return nil
+}
+
+func (server *Server) deviceIndex(serial string) int {
+	for i, device := range server.devices {
+		if device.Serial == serial {
+			return i
+		}
+	}
+	return -1
+}
+
+func (server *Server) listDevices(w http.ResponseWriter) {
+	devices := make([]Device, len(server.devices))
+	for i, device := range server.devices {
+		devices[i] = *device
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "devices": devices})
+	for serial, owner := range server.takenOnList {
+		if device := server.findDevice(serial); device != nil {
+			taker := owner
+			device.Owner = &taker
+		}
+		delete(server.takenOnList, serial)
+	}
+}
+
+func (server *Server) getDevice(w http.ResponseWriter, serial string) {
+	device := server.findDevice(serial)
+	if device == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "description": "Device not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "device": device})
+}
+
+func (server *Server) listUserDevices(w http.ResponseWriter, user Owner) {
+	devices := []Device{}
+	for _, device := range server.devices {
+		if device.Owner != nil && device.Owner.Email == user.Email {
+			owned := *device
+			owned.RemoteConnectURL = server.remoteConnects[device.Serial]
+			devices = append(devices, owned)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "devices": devices})
+}
+
+func (server *Server) addUserDevice(w http.ResponseWriter, r *http.Request, user Owner) {
+	var body struct {
+		Serial string `json:"serial"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "description": "Bad Request"})
+		return
+	}
+	device := server.findDevice(body.Serial)
+	switch {
+	case device == nil:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "description": "Device not found"})
+	case !device.Present || device.Owner != nil:
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "description": "Device is being used or not available"})
+	default:
+		owner := user
+		now := time.Now()
+		device.Owner = &owner
+		device.UsageChangedAt = &now
+		server.broadcastDeviceChange(device)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "description": "Device successfully added"})
+	}
+}
+
+func (server *Server) deleteUserDevice(w http.ResponseWriter, serial string, user Owner) {
+	device := server.findDevice(serial)
+	if device == nil || device.Owner == nil || device.Owner.Email != user.Email {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "description": "You cannot release this device. Not owned by you"})
+		return
+	}
+	device.Owner = nil
+	delete(server.remoteConnects, serial)
+	server.broadcastDeviceChange(device)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "description": "Device successfully removed"})
+}
+
+func (server *Server) remoteConnect(w http.ResponseWriter, serial string, user Owner) {
+	device := server.findDevice(serial)
+	if device == nil || device.Owner == nil || device.Owner.Email != user.Email {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "description": "Device is not owned by you or is not available"})
+		return
+	}
+	remoteConnectURL := fmt.Sprintf("%s:%d", server.Listener.Addr().(*net.TCPAddr).IP, remoteConnectBasePort+2*server.deviceIndex(serial))
+	server.remoteConnects[serial] = remoteConnectURL
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "remoteConnectUrl": remoteConnectURL, "serial": serial})
+}
+
+func (server *Server) remoteDisconnect(w http.ResponseWriter, serial string, user Owner) {
+	device := server.findDevice(serial)
+	if device == nil || device.Owner == nil || device.Owner.Email != user.Email {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "description": "Device is not owned by you or is not available"})
+		return
+	}
+	delete(server.remoteConnects, serial)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "description": "Device remote disconnected successfully"})
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func userDeviceSerial(path string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(path, userDevicesPath+"/"), "/remoteConnect")
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
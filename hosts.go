@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stfHost struct {
+	url           string
+	accessToken   string
+	sessionCookie string
+}
+
+type deviceCandidate struct {
+	serial string
+	host   stfHost
+	owned  bool
+}
+
+func (configs *configsModel) getHosts() ([]stfHost, error) {
+	hosts, err := pairHostsWithTokens(parseList(configs.stfHostURL), parseList(configs.stfAccessToken))
+	if err != nil {
+		return nil, err
+	}
+	cookies := parseList(configs.stfSessionCookie)
+	if len(cookies) > 1 && len(cookies) != len(hosts) {
+		return nil, fmt.Errorf("number of STF session cookies (%d) does not match number of STF hosts (%d)", len(cookies), len(hosts))
+	}
+	for i := range hosts {
+		if len(cookies) == 1 {
+			hosts[i].sessionCookie = cookies[0]
+		} else if len(cookies) > 1 {
+			hosts[i].sessionCookie = cookies[i]
+		}
+	}
+	return hosts, nil
+}
+
+func (configs *configsModel) getFallbackHosts() ([]stfHost, error) {
+	urls := parseList(configs.stfFallbackHostURLs)
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	tokens := parseList(configs.stfFallbackAccessTokens)
+	if len(tokens) != len(urls) {
+		return nil, fmt.Errorf("number of STF fallback access tokens (%d) does not match number of STF fallback hosts (%d)", len(tokens), len(urls))
+	}
+	return pairHostsWithTokens(urls, tokens)
+}
+
+// pairHostsWithTokens pairs STF host URLs with access tokens. Single access token is shared by all the hosts.
+func pairHostsWithTokens(urls, tokens []string) ([]stfHost, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("STF host cannot be empty")
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("STF access token cannot be empty")
+	}
+	if len(tokens) != 1 && len(tokens) != len(urls) {
+		return nil, fmt.Errorf("number of STF access tokens (%d) does not match number of STF hosts (%d)", len(tokens), len(urls))
+	}
+	hosts := make([]stfHost, len(urls))
+	for i, url := range urls {
+		if !strings.HasPrefix(url, "http") {
+			return nil, fmt.Errorf("invalid STF host: %s", url)
+		}
+		token := tokens[0]
+		if len(tokens) > 1 {
+			token = tokens[i]
+		}
+		hosts[i] = stfHost{url: strings.TrimSuffix(url, "/"), accessToken: token}
+	}
+	return hosts, nil
+}
+
+func (configs *configsModel) getHostURLs() []string {
+	hosts, err := configs.getHosts()
+	if err != nil {
+		return parseList(configs.stfHostURL)
+	}
+	return getHostURLs(hosts)
+}
+
+// hostLister lists matching free devices of single host.
+type hostLister func(configs configsModel, host stfHost) ([]deviceCandidate, error)
+
+// getCandidates queries all the hosts concurrently and merges their matching devices in random order.
+// Hosts which cannot be queried are ignored unless all of them fail.
+func getCandidates(configs configsModel, hosts []stfHost) ([]deviceCandidate, error) {
+	return listCandidates(configs, hosts, getHostCandidates, false)
+}
+
+// listCandidates lists devices of all the hosts with listHost like getCandidates. Quiet listing does not log its results.
+func listCandidates(configs configsModel, hosts []stfHost, listHost hostLister, quiet bool) ([]deviceCandidate, error) {
+	hostCandidates := make([][]deviceCandidate, len(hosts))
+	errs := make([]error, len(hosts))
+	durations := make([]time.Duration, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host stfHost) {
+			defer wg.Done()
+			start := time.Now()
+			hostCandidates[i], errs[i] = listHost(configs, host)
+			durations[i] = time.Since(start)
+		}(i, host)
+	}
+	wg.Wait()
+
+	var candidates []deviceCandidate
+	var failedHostErrors []string
+	for i, host := range hosts {
+		event := flowEvent{phase: "list", host: host.url, duration: durations[i], err: errs[i]}
+		if errs[i] != nil {
+			if !quiet {
+				event.logf("Could not get devices from %s", host.url)
+			}
+			failedHostErrors = append(failedHostErrors, fmt.Sprintf("%s: %s", host.url, errs[i]))
+			continue
+		}
+		if !quiet {
+			event.logf("Found %d matching devices on %s", len(hostCandidates[i]), host.url)
+		}
+		candidates = appendUniqueCandidates(candidates, hostCandidates[i], quiet)
+	}
+	if len(failedHostErrors) == len(hosts) {
+		return nil, errors.New(strings.Join(failedHostErrors, " | "))
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("could not find present, not used devices satisfying filter: %s", configs.getDeviceFilter())
+	}
+	shuffleCandidates(candidates)
+	return candidates, nil
+}
+
+// appendUniqueCandidates skips devices with serials already provided by preceding hosts,
+// so serials and host map exported for connected devices stay unambiguous.
+func appendUniqueCandidates(candidates, hostCandidates []deviceCandidate, quiet bool) []deviceCandidate {
+	for _, candidate := range hostCandidates {
+		if index := findCandidate(candidates, candidate.serial); index >= 0 {
+			if !quiet {
+				log.Warnf("Device %s from %s ignored, already provided by %s", candidate.serial, candidate.host.url, candidates[index].host.url)
+			}
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+func findCandidate(candidates []deviceCandidate, serial string) int {
+	for i, candidate := range candidates {
+		if candidate.serial == serial {
+			return i
+		}
+	}
+	return -1
+}
+
+func getHostCandidates(configs configsModel, host stfHost) ([]deviceCandidate, error) {
+	var ownedSerials []string
+	if configs.isOwnedDevicesHandlingEnabled() {
+		var err error
+		if ownedSerials, err = prepareOwnedDevices(configs, host, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	serials, err := getSerials(configs, host, ownedSerials)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]deviceCandidate, len(serials))
+	for i, serial := range serials {
+		candidates[i] = deviceCandidate{serial: serial, host: host, owned: containsString(ownedSerials, serial)}
+	}
+	return candidates, nil
+}
+
+// getCandidatesWithFallback tries primary hosts first and then each fallback host in order,
+// until one of them is reachable and has matching free devices. Hosts which provided candidates are returned too.
+func getCandidatesWithFallback(configs configsModel, primaryHosts, fallbackHosts []stfHost) ([]deviceCandidate, []stfHost, error) {
+	return listCandidatesWithFallback(configs, primaryHosts, fallbackHosts, getHostCandidates, false)
+}
+
+// listCandidatesWithFallback lists devices with listHost like getCandidatesWithFallback. Quiet listing does not log which hosts are tried.
+func listCandidatesWithFallback(configs configsModel, primaryHosts, fallbackHosts []stfHost, listHost hostLister, quiet bool) ([]deviceCandidate, []stfHost, error) {
+	hostGroups := [][]stfHost{primaryHosts}
+	for _, host := range fallbackHosts {
+		hostGroups = append(hostGroups, []stfHost{host})
+	}
+	var groupErrors []string
+	for i, hosts := range hostGroups {
+		if i > 0 && !quiet {
+			log.Warnf("Trying fallback STF host %s", hosts[0].url)
+		}
+		candidates, err := listCandidates(configs, hosts, listHost, quiet)
+		if err == nil {
+			if !quiet {
+				log.Donef("Using STF hosts: %s", strings.Join(getHostURLs(hosts), ", "))
+			}
+			return candidates, hosts, nil
+		}
+		groupErrors = append(groupErrors, err.Error())
+	}
+	return nil, nil, errors.New(strings.Join(groupErrors, " | "))
+}
+
+func getHostURLs(hosts []stfHost) []string {
+	urls := make([]string, len(hosts))
+	for i, host := range hosts {
+		urls[i] = host.url
+	}
+	return urls
+}
+
+func getCandidateSerials(candidates []deviceCandidate) []string {
+	serials := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		serials[i] = candidate.serial
+	}
+	return serials
+}
+
+func shuffleCandidates(slice []deviceCandidate) {
+	for i := range slice {
+		j := random.Intn(i + 1)
+		slice[i], slice[j] = slice[j], slice[i]
+	}
+}
+
+func exportDeviceHosts(exporter outputExporter, keyStr string, devices []connectedDevice) error {
+	deviceHosts := map[string]string{}
+	for _, device := range devices {
+		deviceHosts[device.serial] = device.host.url
+	}
+	body, err := json.Marshal(deviceHosts)
+	if err != nil {
+		return err
+	}
+	return exporter.export(keyStr, string(body))
+}
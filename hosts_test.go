@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGetHostsSharedToken(t *testing.T) {
+	configs := configsModel{stfHostURL: "https://office.example.com/|https://dc.example.com", stfAccessToken: "token"}
+	hosts, err := configs.getHosts()
+	require.NoError(t, err)
+	require.Equal(t, []stfHost{{url: "https://office.example.com", accessToken: "token"}, {url: "https://dc.example.com", accessToken: "token"}}, hosts)
+}
+
+func TestGetHostsTokenPerHost(t *testing.T) {
+	configs := configsModel{stfHostURL: "https://office.example.com\nhttps://dc.example.com", stfAccessToken: "office\ndc"}
+	hosts, err := configs.getHosts()
+	require.NoError(t, err)
+	require.Equal(t, []stfHost{{url: "https://office.example.com", accessToken: "office"}, {url: "https://dc.example.com", accessToken: "dc"}}, hosts)
+}
+
+func TestGetHostsSessionCookies(t *testing.T) {
+	configs := configsModel{stfHostURL: "https://office.example.com|https://dc.example.com", stfAccessToken: "token", stfSessionCookie: "ssid=a; ssid.sig=b"}
+	hosts, err := configs.getHosts()
+	require.NoError(t, err)
+	require.Equal(t, "ssid=a; ssid.sig=b", hosts[1].sessionCookie)
+
+	configs.stfSessionCookie = "ssid=office|ssid=dc"
+	hosts, err = configs.getHosts()
+	require.NoError(t, err)
+	require.Equal(t, []string{"ssid=office", "ssid=dc"}, []string{hosts[0].sessionCookie, hosts[1].sessionCookie})
+
+	configs.stfSessionCookie = "ssid=a|ssid=b|ssid=c"
+	_, err = configs.getHosts()
+	require.Error(t, err)
+}
+
+func TestGetHostsInvalid(t *testing.T) {
+	_, err := (&configsModel{stfHostURL: "https://a.example.com|https://b.example.com|https://c.example.com", stfAccessToken: "a|b"}).getHosts()
+	require.Error(t, err)
+	_, err = (&configsModel{stfHostURL: "https://a.example.com|b.example.com", stfAccessToken: "token"}).getHosts()
+	require.Error(t, err)
+	_, err = (&configsModel{stfAccessToken: "token"}).getHosts()
+	require.Error(t, err)
+}
+
+func TestGetCandidatesMergesHosts(t *testing.T) {
+	skipWithoutJQ(t)
+	office := newDevicesServer(`{"devices":[{"serial":"a","present":true,"owner":null},{"serial":"b","present":true,"owner":{}}]}`)
+	defer office.Close()
+	dataCenter := newDevicesServer(`{"devices":[{"serial":"c","present":true,"owner":null}]}`)
+	defer dataCenter.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	hosts := []stfHost{{url: office.URL, accessToken: "office"}, {url: dataCenter.URL, accessToken: "dc"}, {url: broken.URL, accessToken: "broken"}}
+	candidates, err := getCandidates(configs, hosts)
+	require.NoError(t, err)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].serial < candidates[j].serial })
+	require.Equal(t, []deviceCandidate{{serial: "a", host: hosts[0]}, {serial: "c", host: hosts[1]}}, candidates)
+}
+
+func TestGetCandidatesSkipsDuplicateSerials(t *testing.T) {
+	skipWithoutJQ(t)
+	office := newDevicesServer(`{"devices":[{"serial":"a","present":true,"owner":null}]}`)
+	defer office.Close()
+	dataCenter := newDevicesServer(`{"devices":[{"serial":"a","present":true,"owner":null},{"serial":"b","present":true,"owner":null}]}`)
+	defer dataCenter.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	hosts := []stfHost{{url: office.URL, accessToken: "office"}, {url: dataCenter.URL, accessToken: "dc"}}
+	candidates, err := getCandidates(configs, hosts)
+	require.NoError(t, err)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].serial < candidates[j].serial })
+	require.Equal(t, []deviceCandidate{{serial: "a", host: hosts[0]}, {serial: "b", host: hosts[1]}}, candidates)
+}
+
+func TestGetCandidatesAllHostsFailed(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer broken.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	_, err := getCandidates(configs, []stfHost{{url: broken.URL, accessToken: "token"}})
+	require.Error(t, err)
+}
+
+func TestGetCandidatesNoDevices(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newDevicesServer(`{"devices":[{"serial":"a","present":false,"owner":null}]}`)
+	defer server.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	_, err := getCandidates(configs, []stfHost{{url: server.URL, accessToken: "token"}})
+	require.Error(t, err)
+}
+
+func newDevicesServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != devicesEndpoint {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestGetFallbackHosts(t *testing.T) {
+	hosts, err := (&configsModel{}).getFallbackHosts()
+	require.NoError(t, err)
+	require.Nil(t, hosts)
+
+	hosts, err = (&configsModel{stfFallbackHostURLs: "https://a.example.com|https://b.example.com", stfFallbackAccessTokens: "a|b"}).getFallbackHosts()
+	require.NoError(t, err)
+	require.Equal(t, []stfHost{{url: "https://a.example.com", accessToken: "a"}, {url: "https://b.example.com", accessToken: "b"}}, hosts)
+
+	_, err = (&configsModel{stfFallbackHostURLs: "https://a.example.com|https://b.example.com", stfFallbackAccessTokens: "token"}).getFallbackHosts()
+	require.Error(t, err)
+}
+
+func TestGetCandidatesWithFallbackPrimaryWithoutDevices(t *testing.T) {
+	skipWithoutJQ(t)
+	primary := newDevicesServer(`{"devices":[{"serial":"a","present":true,"owner":{}}]}`)
+	defer primary.Close()
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable.Close()
+	fallback := newDevicesServer(`{"devices":[{"serial":"b","present":true,"owner":null}]}`)
+	defer fallback.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	primaryHosts := []stfHost{{url: primary.URL, accessToken: "primary"}}
+	fallbackHosts := []stfHost{{url: unreachable.URL, accessToken: "unreachable"}, {url: fallback.URL, accessToken: "fallback"}}
+	candidates, usedHosts, err := getCandidatesWithFallback(configs, primaryHosts, fallbackHosts)
+	require.NoError(t, err)
+	require.Equal(t, []deviceCandidate{{serial: "b", host: fallbackHosts[1]}}, candidates)
+	require.Equal(t, []stfHost{fallbackHosts[1]}, usedHosts)
+}
+
+func TestGetCandidatesWithFallbackPrimaryUsed(t *testing.T) {
+	skipWithoutJQ(t)
+	primary := newDevicesServer(`{"devices":[{"serial":"a","present":true,"owner":null}]}`)
+	defer primary.Close()
+
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second}
+	primaryHosts := []stfHost{{url: primary.URL, accessToken: "primary"}}
+	candidates, usedHosts, err := getCandidatesWithFallback(configs, primaryHosts, []stfHost{{url: "http://127.0.0.1:1", accessToken: "fallback"}})
+	require.NoError(t, err)
+	require.Equal(t, []deviceCandidate{{serial: "a", host: primaryHosts[0]}}, candidates)
+	require.Equal(t, primaryHosts, usedHosts)
+}
+
+func TestGetCandidatesWithFallbackAllFailed(t *testing.T) {
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second, connectTimeout: time.Second}
+	_, _, err := getCandidatesWithFallback(configs, []stfHost{{url: "http://127.0.0.1:1", accessToken: "primary"}}, nil)
+	require.Error(t, err)
+}
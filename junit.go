@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	testResultSubdirectory = "stf-device-acquisition"
+	junitReportFileName    = "stf-device-acquisition.xml"
+	testInfoFileName       = "test-info.json"
+	junitSuiteName         = "STF device acquisition"
+)
+
+type acquisitionAttempt struct {
+	serial   string
+	host     string
+	duration time.Duration
+	err      error
+}
+
+// acquisitionReport collects results of connecting devices, it is nil if JUnit report is disabled.
+type acquisitionReport struct {
+	started  time.Time
+	attempts []acquisitionAttempt
+}
+
+func newAcquisitionReport(configs configsModel) *acquisitionReport {
+	if configs.testResultDir == "" {
+		return nil
+	}
+	return &acquisitionReport{started: time.Now()}
+}
+
+func (report *acquisitionReport) record(attempt acquisitionAttempt) {
+	if report == nil {
+		return
+	}
+	report.attempts = append(report.attempts, attempt)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (report *acquisitionReport) toJUnit() junitTestSuites {
+	suite := junitTestSuite{
+		Name:      junitSuiteName,
+		Tests:     len(report.attempts),
+		Timestamp: report.started.UTC().Format("2006-01-02T15:04:05"),
+	}
+	var totalDuration time.Duration
+	for _, attempt := range report.attempts {
+		testCase := junitTestCase{ClassName: attempt.host, Name: attempt.serial, Time: formatJUnitSeconds(attempt.duration)}
+		if attempt.err != nil {
+			message := secretRedactor.redact(attempt.err.Error())
+			testCase.Failure = &junitFailure{Message: message, Text: message}
+			suite.Failures++
+		}
+		totalDuration += attempt.duration
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Time = formatJUnitSeconds(totalDuration)
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+func formatJUnitSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
+
+// write saves JUnit report along with test-info.json required by Bitrise test reports into own subdirectory
+// of test result directory, as Bitrise expects from each step, and returns the report path.
+func (report *acquisitionReport) write(testResultDir string) (string, error) {
+	directory := filepath.Join(testResultDir, testResultSubdirectory)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", err
+	}
+	content, err := xml.MarshalIndent(report.toJUnit(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	reportPath := filepath.Join(directory, junitReportFileName)
+	if err := ioutil.WriteFile(reportPath, append([]byte(xml.Header), content...), 0644); err != nil {
+		return "", err
+	}
+	testInfo, err := json.Marshal(map[string]string{"test-name": junitSuiteName})
+	if err != nil {
+		return "", err
+	}
+	return reportPath, ioutil.WriteFile(filepath.Join(directory, testInfoFileName), testInfo, 0644)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquisitionReportDisabled(t *testing.T) {
+	report := newAcquisitionReport(configsModel{})
+	require.Nil(t, report)
+	report.record(acquisitionAttempt{serial: "a"})
+}
+
+func TestAcquisitionReportToJUnit(t *testing.T) {
+	report := &acquisitionReport{started: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	report.record(acquisitionAttempt{serial: "a", host: "https://stf.example.com", duration: 1500 * time.Millisecond})
+	report.record(acquisitionAttempt{serial: "b", host: "https://stf.example.com", duration: 250 * time.Millisecond, err: errors.New("could not connect to ADB")})
+
+	require.Equal(t, junitTestSuites{Suites: []junitTestSuite{{
+		Name:      junitSuiteName,
+		Tests:     2,
+		Failures:  1,
+		Time:      "1.750",
+		Timestamp: "2020-01-02T03:04:05",
+		TestCases: []junitTestCase{
+			{ClassName: "https://stf.example.com", Name: "a", Time: "1.500"},
+			{ClassName: "https://stf.example.com", Name: "b", Time: "0.250", Failure: &junitFailure{Message: "could not connect to ADB", Text: "could not connect to ADB"}},
+		},
+	}}}, report.toJUnit())
+}
+
+func TestAcquisitionReportWrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_junit_test")
+	require.NoError(t, err)
+	report := &acquisitionReport{started: time.Now()}
+	report.record(acquisitionAttempt{serial: "a", host: "https://stf.example.com", err: errors.New(`request failed, body: <"&>`)})
+
+	reportPath, err := report.write(filepath.Join(tempDir, "results"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(tempDir, "results", testResultSubdirectory, junitReportFileName), reportPath)
+	content, err := ioutil.ReadFile(reportPath)
+	require.NoError(t, err)
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(content, &suites))
+	require.Equal(t, `request failed, body: <"&>`, suites.Suites[0].TestCases[0].Failure.Message)
+
+	testInfo, err := ioutil.ReadFile(filepath.Join(tempDir, "results", testResultSubdirectory, testInfoFileName))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"test-name":"STF device acquisition"}`, string(testInfo))
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type lease struct {
+	Host             string    `json:"host"`
+	Serial           string    `json:"serial"`
+	RemoteConnectURL string    `json:"remoteConnectUrl"`
+	AcquiredAt       time.Time `json:"acquiredAt"`
+	BuildSlug        string    `json:"buildSlug"`
+}
+
+type leaseLedger struct {
+	Leases []lease `json:"leases"`
+}
+
+func expandHomeDir(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := getHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
+}
+
+// updateLedger applies update to ledger stored at path while holding exclusive lock, so concurrent builds on the same machine don't lose leases.
+func updateLedger(path string, update func(ledger *leaseLedger)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lockFile.Close(); err != nil {
+			log.Warnf("Failed to close ledger lock file, error: %s", err)
+		}
+	}()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("could not lock ledger, error: %s", err)
+	}
+
+	ledger, err := readLedger(path)
+	if err != nil {
+		return err
+	}
+	update(ledger)
+	content, err := json.MarshalIndent(ledger, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, content)
+}
+
+// readLedger returns ledger stored at path or empty one if it does not exist yet. Ledger is written atomically, so no lock is needed.
+func readLedger(path string) (*leaseLedger, error) {
+	ledger := &leaseLedger{}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, ledger); err != nil {
+		return nil, fmt.Errorf("could not parse %s, error: %s", path, err)
+	}
+	return ledger, nil
+}
+
+func recordLease(configs configsModel, device connectedDevice) {
+	if configs.leaseLedgerPath == "" {
+		return
+	}
+	newLease := lease{
+		Host:             device.host.url,
+		Serial:           device.serial,
+		RemoteConnectURL: device.remoteConnectURL,
+		AcquiredAt:       time.Now(),
+		BuildSlug:        configs.buildSlug,
+	}
+	err := updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		ledger.Leases = append(removeLeases(ledger.Leases, device.host.url, device.serial), newLease)
+	})
+	if err != nil {
+		log.Warnf("Could not record lease of device %s, error: %s", device.serial, err)
+	}
+}
+
+func removeLease(configs configsModel, device connectedDevice) {
+	if configs.leaseLedgerPath == "" {
+		return
+	}
+	err := updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		ledger.Leases = removeLeases(ledger.Leases, device.host.url, device.serial)
+	})
+	if err != nil {
+		log.Warnf("Could not remove lease of device %s, error: %s", device.serial, err)
+	}
+}
+
+func removeLeases(leases []lease, hostURL, serial string) []lease {
+	var remainingLeases []lease
+	for _, existingLease := range leases {
+		if existingLease.Host != hostURL || existingLease.Serial != serial {
+			remainingLeases = append(remainingLeases, existingLease)
+		}
+	}
+	return remainingLeases
+}
+
+// isLeaseDead reports whether build which acquired lease is not running anymore.
+// Step processes do not outlive build steps, so only leases of the current build are known to be alive,
+// leases of other builds are considered dead once they are older than maximum lease age. Maximum age 0 means leases never die.
+func isLeaseDead(configs configsModel, existingLease lease, now time.Time) bool {
+	if configs.leaseMaxAge <= 0 || existingLease.BuildSlug != "" && existingLease.BuildSlug == configs.buildSlug {
+		return false
+	}
+	return now.Sub(existingLease.AcquiredAt) > configs.leaseMaxAge
+}
+
+// getLiveLeaseSerials returns serials of devices from host leased by builds which may still be running.
+func getLiveLeaseSerials(configs configsModel, hostURL string, now time.Time) ([]string, error) {
+	if configs.leaseLedgerPath == "" {
+		return nil, nil
+	}
+	ledger, err := readLedger(configs.leaseLedgerPath)
+	if err != nil {
+		return nil, err
+	}
+	var serials []string
+	for _, existingLease := range ledger.Leases {
+		if existingLease.Host == hostURL && !isLeaseDead(configs, existingLease, now) {
+			serials = append(serials, existingLease.Serial)
+		}
+	}
+	return serials, nil
+}
+
+// getLeasedAdbAddress returns address ADB has been connected to device from host at, if it is leased according to ledger.
+func getLeasedAdbAddress(configs configsModel, hostURL, serial string) (string, bool) {
+	if configs.leaseLedgerPath == "" {
+		return "", false
+	}
+	ledger, err := readLedger(configs.leaseLedgerPath)
+	if err != nil {
+		log.Warnf("Could not read lease ledger, error: %s", err)
+		return "", false
+	}
+	for _, existingLease := range ledger.Leases {
+		if existingLease.Host == hostURL && existingLease.Serial == serial {
+			return existingLease.RemoteConnectURL, true
+		}
+	}
+	return "", false
+}
+
+// releaseDeadLeases releases devices leased by builds which are not running anymore.
+// Device is released only if STF user still owns it since before the lease was written, so devices released by the build
+// and reserved again afterwards e.g. by another build sharing the access token are left alone.
+// Leases of devices which are not owned anymore are dropped. Leases of hosts for which owned devices are not known are kept.
+func releaseDeadLeases(configs configsModel, hosts []stfHost) error {
+	return updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		now := time.Now()
+		ownedDevices := getLeasedHostsOwnedDevices(configs, hosts, ledger.Leases)
+		var remainingLeases []lease
+		for _, existingLease := range ledger.Leases {
+			devices, ok := ownedDevices[existingLease.Host]
+			if !ok {
+				remainingLeases = append(remainingLeases, existingLease)
+				continue
+			}
+			device, ok := findOwnedDevice(devices, existingLease.Serial)
+			if !ok {
+				log.Debugf("Dropping lease of device %s from %s, it is not owned by STF user anymore", existingLease.Serial, existingLease.Host)
+				continue
+			}
+			if !isLeaseDead(configs, existingLease, now) {
+				remainingLeases = append(remainingLeases, existingLease)
+				continue
+			}
+			if device.UsageChangedAt == nil {
+				log.Warnf("Could not release device %s leased by dead build %s, STF does not report since when it is owned", existingLease.Serial, existingLease.BuildSlug)
+				remainingLeases = append(remainingLeases, existingLease)
+				continue
+			}
+			if device.UsageChangedAt.After(existingLease.AcquiredAt) {
+				log.Infof("Dropping lease of device %s from %s, it has been reserved again at %s", existingLease.Serial, existingLease.Host, device.UsageChangedAt.Format(time.RFC3339))
+				continue
+			}
+			log.Warnf("Releasing device %s from %s leased by dead build %s at %s", existingLease.Serial, existingLease.Host, existingLease.BuildSlug, existingLease.AcquiredAt.Format(time.RFC3339))
+			host, _ := findHost(hosts, existingLease.Host)
+			if err := disconnectFromAdb(existingLease.RemoteConnectURL); err != nil {
+				log.Warnf("Could not disconnect ADB from %s, error: %s", existingLease.RemoteConnectURL, err)
+			}
+			if err := removeDeviceFromControl(configs, host, existingLease.Serial); err != nil {
+				log.Warnf("Could not release device %s, error: %s", existingLease.Serial, err)
+			}
+		}
+		ledger.Leases = remainingLeases
+	})
+}
+
+// getLeasedHostsOwnedDevices returns devices owned by STF user on hosts from which devices are leased, keyed by host URL.
+// Hosts for which access token is not known or owned devices cannot be fetched are missing.
+func getLeasedHostsOwnedDevices(configs configsModel, hosts []stfHost, leases []lease) map[string][]OwnedDevice {
+	ownedDevices := map[string][]OwnedDevice{}
+	checkedHosts := map[string]bool{}
+	for _, existingLease := range leases {
+		if checkedHosts[existingLease.Host] {
+			continue
+		}
+		checkedHosts[existingLease.Host] = true
+		host, ok := findHost(hosts, existingLease.Host)
+		if !ok {
+			log.Warnf("Could not check devices leased from unknown STF host: %s", existingLease.Host)
+			continue
+		}
+		devices, err := getOwnedDevices(configs, host)
+		if err != nil {
+			log.Warnf("Could not check devices leased from %s, error: %s", host.url, err)
+			continue
+		}
+		ownedDevices[host.url] = devices
+	}
+	return ownedDevices
+}
+
+func findOwnedDevice(devices []OwnedDevice, serial string) (OwnedDevice, bool) {
+	for _, device := range devices {
+		if device.Serial == serial {
+			return device, true
+		}
+	}
+	return OwnedDevice{}, false
+}
+
+func findHost(hosts []stfHost, url string) (stfHost, bool) {
+	for _, host := range hosts {
+		if host.url == url {
+			return host, true
+		}
+	}
+	return stfHost{}, false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndRemoveLease(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_ledger_test")
+	require.NoError(t, err)
+	configs := configsModel{leaseLedgerPath: filepath.Join(tempDir, ".stf", "leases.json"), buildSlug: "build"}
+	host := stfHost{url: "https://stf.example.com", accessToken: "token"}
+	first := connectedDevice{serial: "first", host: host, remoteConnectURL: "provider:7401"}
+	second := connectedDevice{serial: "second", host: host, remoteConnectURL: "provider:7403"}
+
+	recordLease(configs, first)
+	recordLease(configs, second)
+	recordLease(configs, first)
+	ledger := readTestLedger(t, configs.leaseLedgerPath)
+	require.Len(t, ledger.Leases, 2)
+	require.Equal(t, "second", ledger.Leases[0].Serial)
+	require.Equal(t, "first", ledger.Leases[1].Serial)
+	require.Equal(t, "provider:7401", ledger.Leases[1].RemoteConnectURL)
+	require.Equal(t, "build", ledger.Leases[1].BuildSlug)
+
+	removeLease(configs, second)
+	ledger = readTestLedger(t, configs.leaseLedgerPath)
+	require.Len(t, ledger.Leases, 1)
+	require.Equal(t, "first", ledger.Leases[0].Serial)
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestIsLeaseDead(t *testing.T) {
+	now := time.Now()
+	configs := configsModel{buildSlug: "current", leaseMaxAge: 24 * time.Hour}
+	require.False(t, isLeaseDead(configs, lease{BuildSlug: "current", AcquiredAt: now.Add(-48 * time.Hour)}, now))
+	require.False(t, isLeaseDead(configs, lease{BuildSlug: "other", AcquiredAt: now.Add(-time.Hour)}, now))
+	require.True(t, isLeaseDead(configs, lease{BuildSlug: "other", AcquiredAt: now.Add(-48 * time.Hour)}, now))
+	require.True(t, isLeaseDead(configs, lease{AcquiredAt: now.Add(-48 * time.Hour)}, now))
+
+	configs.buildSlug = ""
+	require.False(t, isLeaseDead(configs, lease{AcquiredAt: now.Add(-time.Hour)}, now))
+
+	configs.leaseMaxAge = 0
+	require.False(t, isLeaseDead(configs, lease{BuildSlug: "other", AcquiredAt: now.Add(-48 * time.Hour)}, now))
+}
+
+// newLedgerTestServer serves given devices owned by STF user and records paths of released ones.
+func newLedgerTestServer(t *testing.T, ownedDevices []OwnedDevice, releasedPaths *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			require.NoError(t, json.NewEncoder(w).Encode(OwnedDevices{Devices: ownedDevices}))
+		case "DELETE":
+			*releasedPaths = append(*releasedPaths, r.URL.Path)
+		}
+	}))
+}
+
+func TestReleaseDeadLeases(t *testing.T) {
+	longAgo := time.Now().Add(-72 * time.Hour)
+	var releasedPaths []string
+	server := newLedgerTestServer(t, []OwnedDevice{
+		{Serial: "dead", UsageChangedAt: &longAgo},
+		{Serial: "alive", UsageChangedAt: &longAgo},
+	}, &releasedPaths)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "stf_ledger_test")
+	require.NoError(t, err)
+	configs := configsModel{leaseLedgerPath: filepath.Join(tempDir, "leases.json"), buildSlug: "current", leaseMaxAge: 24 * time.Hour, controlTimeout: time.Second, listTimeout: time.Second}
+	host := stfHost{url: server.URL, accessToken: "token"}
+	require.NoError(t, updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		ledger.Leases = []lease{
+			{Host: server.URL, Serial: "dead", BuildSlug: "crashed", AcquiredAt: time.Now().Add(-48 * time.Hour)},
+			{Host: server.URL, Serial: "alive", BuildSlug: "running", AcquiredAt: time.Now()},
+			{Host: server.URL, Serial: "disconnected", BuildSlug: "finished", AcquiredAt: time.Now()},
+			{Host: "https://unknown.example.com", Serial: "unknown", BuildSlug: "crashed", AcquiredAt: time.Now().Add(-48 * time.Hour)},
+		}
+	}))
+
+	require.NoError(t, releaseDeadLeases(configs, []stfHost{host}))
+
+	require.Equal(t, []string{userDevicesEndpoint + "/dead"}, releasedPaths)
+	ledger := readTestLedger(t, configs.leaseLedgerPath)
+	require.Equal(t, []string{"alive", "unknown"}, []string{ledger.Leases[0].Serial, ledger.Leases[1].Serial})
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestReleaseDeadLeasesSkipsDevicesReservedAgain(t *testing.T) {
+	reservedAgainAt := time.Now().Add(-time.Hour)
+	var releasedPaths []string
+	server := newLedgerTestServer(t, []OwnedDevice{{Serial: "reserved-again", UsageChangedAt: &reservedAgainAt}, {Serial: "unknown-since"}}, &releasedPaths)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "stf_ledger_test")
+	require.NoError(t, err)
+	configs := configsModel{leaseLedgerPath: filepath.Join(tempDir, "leases.json"), buildSlug: "current", leaseMaxAge: 24 * time.Hour, controlTimeout: time.Second, listTimeout: time.Second}
+	require.NoError(t, updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		ledger.Leases = []lease{
+			{Host: server.URL, Serial: "reserved-again", BuildSlug: "crashed", AcquiredAt: time.Now().Add(-48 * time.Hour)},
+			{Host: server.URL, Serial: "unknown-since", BuildSlug: "crashed", AcquiredAt: time.Now().Add(-48 * time.Hour)},
+		}
+	}))
+
+	require.NoError(t, releaseDeadLeases(configs, []stfHost{{url: server.URL, accessToken: "token"}}))
+
+	require.Empty(t, releasedPaths)
+	ledger := readTestLedger(t, configs.leaseLedgerPath)
+	require.Len(t, ledger.Leases, 1)
+	require.Equal(t, "unknown-since", ledger.Leases[0].Serial)
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestExpandHomeDir(t *testing.T) {
+	homeDir, err := getHomeDir()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(homeDir, ".stf", "leases.json"), expandHomeDir("~/.stf/leases.json"))
+	require.Equal(t, "/tmp/leases.json", expandHomeDir("/tmp/leases.json"))
+}
+
+func readTestLedger(t *testing.T, path string) *leaseLedger {
+	var ledger *leaseLedger
+	require.NoError(t, updateLedger(path, func(l *leaseLedger) { ledger = l }))
+	return ledger
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+// Colors used by go-utils log for each severity.
+var logLevelColors = map[string]string{
+	"\x1b[31;1m": "error",
+	"\x1b[33;1m": "warn",
+	"\x1b[34;1m": "info",
+	"\x1b[32;1m": "done",
+	"\x1b[35;1m": "debug",
+}
+
+var ansiColorPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// jsonLogger is set if JSON log format is used.
+var jsonLogger log.Logger
+
+// logOutput is where log is written to after masking secrets.
+var logOutput io.Writer = os.Stdout
+
+type jsonLogEntry struct {
+	Time     string  `json:"time"`
+	Level    string  `json:"level"`
+	Message  string  `json:"message"`
+	Phase    string  `json:"phase,omitempty"`
+	Serial   string  `json:"serial,omitempty"`
+	Host     string  `json:"host,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func (entry jsonLogEntry) String() string {
+	return entry.Message
+}
+
+func (entry jsonLogEntry) JSON() string {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","message":"could not marshal log entry, error: %s"}`+"\n", err)
+	}
+	return string(body) + "\n"
+}
+
+// jsonLogWriter turns plain go-utils log messages into JSON log entries.
+type jsonLogWriter struct {
+	logger log.Logger
+}
+
+func (writer jsonLogWriter) Write(p []byte) (int, error) {
+	writer.logger.Print(parsePlainLogMessage(string(p), time.Now()))
+	return len(p), nil
+}
+
+func parsePlainLogMessage(message string, now time.Time) jsonLogEntry {
+	level := "normal"
+	for color, colorLevel := range logLevelColors {
+		if strings.HasPrefix(message, color) {
+			level = colorLevel
+		}
+	}
+	return jsonLogEntry{
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: strings.TrimSuffix(ansiColorPattern.ReplaceAllString(message, ""), "\n"),
+	}
+}
+
+func validateLogFormat(format string) error {
+	if format != "" && format != logFormatConsole && format != logFormatJSON {
+		return fmt.Errorf("unsupported log format: %s, supported formats: %s, %s", format, logFormatConsole, logFormatJSON)
+	}
+	return nil
+}
+
+// setLogFormat switches all the logging to one JSON object per line if JSON format is requested.
+// Secrets are masked in both formats.
+func setLogFormat(format string) {
+	output := redactingWriter{writer: logOutput}
+	if format != logFormatJSON {
+		jsonLogger = nil
+		log.SetOutWriter(output)
+		return
+	}
+	jsonLogger = log.NewJSONLoger(output)
+	log.SetOutWriter(jsonLogWriter{logger: jsonLogger})
+}
+
+// flowEvent is outcome of a flow phase for a host or device, logged with all its fields in JSON log format.
+type flowEvent struct {
+	phase    string
+	serial   string
+	host     string
+	duration time.Duration
+	err      error
+}
+
+// logf logs event message as info on success or as warning with error appended on failure.
+func (event flowEvent) logf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	if jsonLogger == nil {
+		if event.err != nil {
+			log.Warnf("%s, error: %s", message, event.err)
+		} else {
+			log.Infof(message)
+		}
+		return
+	}
+	entry := jsonLogEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Level:    "info",
+		Message:  message,
+		Phase:    event.phase,
+		Serial:   event.serial,
+		Host:     event.host,
+		Duration: event.duration.Seconds(),
+	}
+	if event.err != nil {
+		entry.Level = "warn"
+		entry.Error = event.err.Error()
+	}
+	jsonLogger.Print(entry)
+}
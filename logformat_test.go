@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidateLogFormat(t *testing.T) {
+	require.NoError(t, validateLogFormat(""))
+	require.NoError(t, validateLogFormat(logFormatJSON))
+	require.Error(t, validateLogFormat("xml"))
+}
+
+func TestParsePlainLogMessage(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Equal(t, jsonLogEntry{Time: "2020-01-02T03:04:05Z", Level: "warn", Message: "Device a ignored"}, parsePlainLogMessage("\x1b[33;1mDevice a ignored\x1b[0m\n", now))
+	require.Equal(t, jsonLogEntry{Time: "2020-01-02T03:04:05Z", Level: "normal", Message: "- removed files: "}, parsePlainLogMessage("- removed files: \n", now))
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	var output bytes.Buffer
+	jsonLogger = log.NewJSONLoger(&output)
+	log.SetOutWriter(jsonLogWriter{logger: jsonLogger})
+	defer func() {
+		jsonLogger = nil
+		log.SetOutWriter(os.Stdout)
+	}()
+
+	log.Errorf("Could not validate config")
+	flowEvent{phase: "connect", serial: "a", host: "https://stf.example.com", duration: 1500 * time.Millisecond, err: errors.New("timeout")}.logf("Device %s ignored", "a")
+
+	decoder := json.NewDecoder(&output)
+	var entry jsonLogEntry
+	require.NoError(t, decoder.Decode(&entry))
+	require.Equal(t, "error", entry.Level)
+	require.Equal(t, "Could not validate config", entry.Message)
+
+	entry = jsonLogEntry{}
+	require.NoError(t, decoder.Decode(&entry))
+	entry.Time = ""
+	require.Equal(t, jsonLogEntry{Level: "warn", Message: "Device a ignored", Phase: "connect", Serial: "a", Host: "https://stf.example.com", Duration: 1.5, Error: "timeout"}, entry)
+	require.False(t, decoder.More())
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -19,12 +19,88 @@ import (
 )
 
 type configsModel struct {
-	stfHostURL        string
-	stfAccessToken    string
+	stfHostURL     string
+	stfAccessToken string
+
+	configFilePath      string
+	pool                string
+	deviceNumberMinimum int
+
+	deviceWaitTimeout      time.Duration
+	deviceWaitPollInterval time.Duration
+	deviceWaitEvents       bool
+	stfSessionCookie       string
+
+	remoteConnectHostRewrite string
+	remoteConnectPortOffset  int
+	remoteConnectPortMap     string
+
+	adbProxyURL         string
+	adbRelayIdleTimeout time.Duration
+
+	stfFallbackHostURLs     string
+	stfFallbackAccessTokens string
+
 	deviceFilter      string
 	deviceNumberLimit int
+
+	minSdk          int
+	maxSdk          int
+	manufacturers   []string
+	modelRegex      string
+	abis            []string
+	minDisplayWidth int
+	providers       []string
+	includeSerials  []string
+	excludeSerials  []string
+
+	minBatteryLevel       int
+	maxBatteryTemperature float64
+
 	adbKeyPub         string
 	adbKey            string
+	apkPaths          []string
+	testApkPaths      []string
+	apkInstallOptions string
+
+	reclaimOwnedDevices    bool
+	releaseStaleOwnedAfter time.Duration
+
+	cleanupPackagePrefixes   []string
+	cleanupClearDataPackages []string
+	cleanupSdcardPath        string
+
+	collectDeviceProperties bool
+	deployDir               string
+	testResultDir           string
+
+	caCertificate      string
+	clientCertificate  string
+	clientKey          string
+	proxyURL           string
+	noProxy            string
+	insecureSkipVerify bool
+
+	connectTimeout time.Duration
+	listTimeout    time.Duration
+	controlTimeout time.Duration
+	requestRate    float64
+	verboseLog     bool
+
+	quarantineHistoryPath string
+	quarantineFailureRate float64
+	quarantineWindow      int
+	quarantineMinAttempts int
+	quarantineCooldown    time.Duration
+	quarantineMode        string
+
+	leaseLedgerPath string
+	leaseMaxAge     time.Duration
+	buildSlug       string
+
+	outputFormat string
+	dotenvPath   string
+	logFormat    string
 }
 
 //Device ...
@@ -32,6 +108,14 @@ type Device struct {
 	Serial string `json:"serial"`
 }
 
+// connectedDevice remoteConnectURL is address ADB is connected to, stfRemoteConnectURL is the one reported by STF before rewriting.
+type connectedDevice struct {
+	serial              string
+	host                stfHost
+	remoteConnectURL    string
+	stfRemoteConnectURL string
+}
+
 //RemoteConnection ...
 type RemoteConnection struct {
 	RemoteConnectURL string `json:"remoteConnectUrl"`
@@ -42,56 +126,227 @@ const userDevicesEndpoint = "/api/v1/user/devices"
 
 var random = rand.New(rand.NewSource(time.Now().UnixNano()))
 
-var client = &http.Client{Timeout: time.Second * 30}
+var client = &http.Client{}
+
+// Outputs of adb connect meaning that device could not be connected.
+var adbConnectFailures = []string{"failed to connect", "unable to connect", "cannot connect"}
 
 func main() {
-	configs := createConfigsModelFromEnvs()
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdout))
+	}
+	inputs, err := loadConfigFile(os.Getenv("config_file"), os.Getenv("pool"))
+	if err != nil {
+		log.Errorf("Could not load config file, error: %s", err)
+		os.Exit(1)
+	}
+	os.Exit(run(createConfigsModelFromEnvs(inputs), os.Stdout))
+}
+
+// run executes the step and returns its exit code. Outputs exported in JSON format are printed to output.
+func run(configs configsModel, output io.Writer) int {
+	log.SetEnableDebugLog(configs.verboseLog)
+	registerSecrets(configs)
+	if configs.getOutputFormat() == outputFormatJSON {
+		// JSON outputs mixed with log could not be parsed.
+		logOutput = os.Stderr
+	}
+	setLogFormat(configs.logFormat)
 	configs.dump()
 	if err := configs.validate(); err != nil {
 		log.Errorf("Could not validate config, error: %s", err)
-		os.Exit(1)
+		return 1
+	}
+
+	transport, err := createHTTPTransport(configs)
+	if err != nil {
+		log.Errorf("Could not configure STF HTTP client, error: %s", err)
+		return 9
 	}
+	client.Transport = transport
+	requestLimiter = newTokenBucket(configs.requestRate)
 
-	serials, err := getSerials(configs)
+	exporter, err := newOutputExporter(configs, output)
+	if err != nil {
+		log.Errorf("Could not configure output export, error: %s", err)
+		return 5
+	}
+
+	apks, err := readApkFiles(append(configs.apkPaths, configs.testApkPaths...))
+	if err != nil {
+		log.Errorf("Could not read APK files, error: %s", err)
+		return 7
+	}
+
+	hosts, err := configs.getHosts()
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	fallbackHosts, err := configs.getFallbackHosts()
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	if configs.leaseLedgerPath != "" {
+		if err := releaseDeadLeases(configs, append(hosts, fallbackHosts...)); err != nil {
+			log.Warnf("Could not release devices leased by dead builds, error: %s", err)
+		}
+	}
+
+	var history *quarantineHistory
+	if configs.isQuarantineEnabled() {
+		if history, err = loadQuarantineHistory(configs.quarantineHistoryPath); err != nil {
+			log.Warnf("Could not load quarantine history, error: %s", err)
+		}
+	}
+	candidates, usedHosts, err := getCandidatesWaiting(configs, hosts, fallbackHosts, history)
 	if err != nil {
 		log.Errorf("Could not get device serials, error: %s", err)
-		os.Exit(2)
+		requestStats.dump()
+		return 2
+	}
+	if history != nil {
+		if candidates = applyQuarantine(configs, history, candidates, time.Now()); len(candidates) == 0 {
+			log.Errorf("Could not get device serials, error: all matching devices are quarantined")
+			requestStats.dump()
+			return 2
+		}
 	}
+
 	homeDir, err := getHomeDir()
 	if err != nil {
 		log.Errorf("Could not determine current user home directory, error: %s", err)
-		os.Exit(3)
+		return 3
 	}
 
 	if err := setAdbKeys(configs, homeDir); err != nil {
 		log.Errorf("Could not set ADB keys, error: %s", err)
-		os.Exit(4)
+		return 4
+	}
+
+	deviceCount := calculateDeviceCount(configs, getCandidateSerials(candidates))
+	var connectedDevices []connectedDevice
+	var installErr error
+	report := newAcquisitionReport(configs)
+
+	for len(connectedDevices) < deviceCount && len(candidates) > 0 && installErr == nil {
+		var newDevices []connectedDevice
+		newDevices, candidates = connectDevices(configs, history, report, candidates, deviceCount-len(connectedDevices))
+		if configs.isCleanupEnabled() {
+			cleanupDevices(configs, newDevices)
+		}
+		if len(apks) > 0 {
+			newDevices, installErr = installApksOnDevices(configs, history, apks, newDevices)
+		}
+		connectedDevices = append(connectedDevices, newDevices...)
 	}
 
-	deviceCount := calculateDeviceCount(configs, serials)
-	var connectedDeviceSerials []string
+	requestStats.dump()
 
-	connectedDeviceCount := 0
-	for _, serial := range serials {
-		if err := connectDeviceToADB(configs, serial); err != nil {
-			log.Warnf("Device %s ignored, error: %s", serial, err)
+	if report != nil {
+		if reportPath, err := report.write(configs.testResultDir); err != nil {
+			log.Warnf("Could not write device acquisition JUnit report, error: %s", err)
 		} else {
-			connectedDeviceCount++
-			connectedDeviceSerials = append(connectedDeviceSerials, serial)
+			log.Infof("Device acquisition JUnit report saved to %s", reportPath)
+		}
+	}
+
+	if history != nil {
+		if err := history.save(configs.quarantineHistoryPath); err != nil {
+			log.Warnf("Could not save quarantine history, error: %s", err)
 		}
-		if connectedDeviceCount >= deviceCount {
-			break
+	}
+
+	if configs.collectDeviceProperties && len(connectedDevices) > 0 {
+		if summaryPath, err := saveDeviceSnapshots(connectedDevices, configs.deployDir); err != nil {
+			log.Warnf("Could not save device properties, error: %s", err)
+		} else if err := exporter.export("STF_DEVICE_PROPERTIES_SUMMARY_PATH", summaryPath); err != nil {
+			log.Warnf("Could not export device properties summary path, error: %s", err)
 		}
 	}
 
-	if err := exportArrayWithEnvman("STF_DEVICE_SERIAL_LIST", connectedDeviceSerials); err != nil {
-		log.Errorf("Could export device serials with envman, error: %s", err)
-		os.Exit(5)
+	logConnectedDevices(connectedDevices)
+	if err := exportArray(exporter, "STF_DEVICE_SERIAL_LIST", getDeviceSerials(connectedDevices)); err != nil {
+		log.Errorf("Could not export device serials, error: %s", err)
+		return 5
+	}
+	if err := exportDeviceHosts(exporter, "STF_DEVICE_HOST_MAP", connectedDevices); err != nil {
+		log.Errorf("Could not export device hosts, error: %s", err)
+		return 5
+	}
+	if err := exportDeviceAddresses(exporter, "STF_DEVICE_ADDRESS_MAP", connectedDevices); err != nil {
+		log.Errorf("Could not export device addresses, error: %s", err)
+		return 5
 	}
-	if connectedDeviceCount == 0 {
+	if err := exporter.export("STF_HOST_URL_USED", strings.Join(getHostURLs(usedHosts), "|")); err != nil {
+		log.Errorf("Could not export used STF host, error: %s", err)
+		return 5
+	}
+	if err := exporter.flush(); err != nil {
+		log.Errorf("Could not export outputs, error: %s", err)
+		return 5
+	}
+	if len(connectedDevices) == 0 {
 		log.Errorf("No devices can be connected to ADB")
-		os.Exit(6)
+		return 6
+	}
+	if len(connectedDevices) < configs.deviceNumberMinimum {
+		log.Errorf("Only %d devices can be connected to ADB, required minimum: %d", len(connectedDevices), configs.deviceNumberMinimum)
+		return 6
 	}
+	if installErr != nil {
+		log.Errorf("Could not install APKs, error: %s", installErr)
+		return 8
+	}
+	return 0
+}
+
+// connectDevices connects up to count devices and returns them along with candidates which have not been tried yet.
+// Connection results are recorded in quarantine history and acquisition report if any.
+func connectDevices(configs configsModel, history *quarantineHistory, report *acquisitionReport, candidates []deviceCandidate, count int) ([]connectedDevice, []deviceCandidate) {
+	var devices []connectedDevice
+	for i, candidate := range candidates {
+		start := time.Now()
+		stfRemoteConnectURL, remoteConnectURL, err := connectDeviceToADB(configs, candidate)
+		history.record(quarantineKey(candidate.host, candidate.serial), err != nil, time.Now(), configs.quarantineWindow)
+		event := flowEvent{phase: "connect", serial: candidate.serial, host: candidate.host.url, duration: time.Since(start), err: err}
+		report.record(acquisitionAttempt{serial: candidate.serial, host: candidate.host.url, duration: event.duration, err: err})
+		if err != nil {
+			event.logf("Device %s from %s ignored", candidate.serial, candidate.host.url)
+		} else {
+			event.logf("Device %s from %s connected", candidate.serial, candidate.host.url)
+			device := connectedDevice{serial: candidate.serial, host: candidate.host, remoteConnectURL: remoteConnectURL, stfRemoteConnectURL: stfRemoteConnectURL}
+			recordLease(configs, device)
+			devices = append(devices, device)
+		}
+		if len(devices) >= count {
+			return devices, candidates[i+1:]
+		}
+	}
+	return devices, nil
+}
+
+func logConnectedDevices(devices []connectedDevice) {
+	if len(devices) == 0 {
+		return
+	}
+	log.Donef("Connected devices:")
+	for _, device := range devices {
+		if device.stfRemoteConnectURL != "" && device.stfRemoteConnectURL != device.remoteConnectURL {
+			log.Printf("%s at %s (%s in STF) from %s", device.serial, device.remoteConnectURL, device.stfRemoteConnectURL, device.host.url)
+		} else {
+			log.Printf("%s at %s from %s", device.serial, device.remoteConnectURL, device.host.url)
+		}
+	}
+}
+
+func getDeviceSerials(devices []connectedDevice) []string {
+	serials := make([]string, len(devices))
+	for i, device := range devices {
+		serials[i] = device.serial
+	}
+	return serials
 }
 
 func calculateDeviceCount(configs configsModel, serials []string) int {
@@ -101,28 +356,165 @@ func calculateDeviceCount(configs configsModel, serials []string) int {
 	return len(serials)
 }
 
-func connectDeviceToADB(configs configsModel, serial string) error {
-	if err := addDeviceUnderControl(configs, serial); err != nil {
-		return fmt.Errorf("could not add device under control, error: %s", err)
+// connectDeviceToADB returns remote connect URL reported by STF and address ADB is connected to, rewritten from the former
+// or local relay address if ADB proxy is set.
+func connectDeviceToADB(configs configsModel, candidate deviceCandidate) (string, string, error) {
+	stfRemoteConnectURL, err := reserveDevice(configs, candidate)
+	if err != nil {
+		return "", "", err
+	}
+	remoteConnectURL, err := rewriteRemoteConnectURL(configs, stfRemoteConnectURL)
+	if err == nil && configs.adbProxyURL != "" {
+		remoteConnectURL, err = startRelay(configs, remoteConnectURL)
+	}
+	if err == nil {
+		err = connectToAdb(remoteConnectURL)
+	}
+	if err != nil {
+		releaseReservedDevice(configs, candidate)
+		return "", "", fmt.Errorf("could not connect to ADB, error: %s", err)
+	}
+	return stfRemoteConnectURL, remoteConnectURL, nil
+}
+
+func rewriteRemoteConnectURL(configs configsModel, stfRemoteConnectURL string) (string, error) {
+	rewriter, err := configs.getRemoteConnectRewriter()
+	if err != nil {
+		return "", err
 	}
-	remoteConnectURL, err := getRemoteConnectURL(configs, serial)
+	remoteConnectURL, err := rewriter.rewrite(stfRemoteConnectURL)
 	if err != nil {
-		return fmt.Errorf("could not get remote connect URL, error: %s", err)
+		return "", err
 	}
-	if err := connectToAdb(remoteConnectURL); err != nil {
-		return fmt.Errorf("could not connect to ADB, error: %s", err)
+	if remoteConnectURL != stfRemoteConnectURL {
+		log.Infof("Remote connect URL %s rewritten to %s", stfRemoteConnectURL, remoteConnectURL)
 	}
-	return nil
+	return remoteConnectURL, nil
+}
+
+// reserveDevice adds device under control of STF user and returns its remote connect URL.
+// Device is released if anything fails after it has been reserved.
+func reserveDevice(configs configsModel, candidate deviceCandidate) (string, error) {
+	host, serial := candidate.host, candidate.serial
+	if candidate.owned {
+		log.Infof("Reclaiming device %s already owned by STF user", serial)
+	} else if err := addDeviceUnderControl(configs, host, serial); err != nil {
+		return "", fmt.Errorf("could not add device under control, error: %s", err)
+	}
+	if configs.isBatteryCheckEnabled() {
+		if err := recheckBattery(configs, host, serial); err != nil {
+			releaseReservedDevice(configs, candidate)
+			return "", fmt.Errorf("battery check after reservation failed, error: %s", err)
+		}
+	}
+	remoteConnectURL, err := getRemoteConnectURL(configs, host, serial)
+	if err != nil {
+		releaseReservedDevice(configs, candidate)
+		return "", fmt.Errorf("could not get remote connect URL, error: %s", err)
+	}
+	return remoteConnectURL, nil
+}
+
+func releaseReservedDevice(configs configsModel, candidate deviceCandidate) {
+	if err := removeDeviceFromControl(configs, candidate.host, candidate.serial); err != nil {
+		log.Warnf("Could not release device %s, error: %s", candidate.serial, err)
+	}
+}
+
+func releaseDevice(configs configsModel, device connectedDevice) error {
+	removeLease(configs, device)
+	if device.remoteConnectURL == "" {
+		log.Debugf("Device %s is not connected to ADB", device.serial)
+	} else if err := disconnectFromAdb(device.remoteConnectURL); err != nil {
+		log.Warnf("Could not disconnect ADB from %s, error: %s", device.remoteConnectURL, err)
+	}
+	return removeDeviceFromControl(configs, device.host, device.serial)
 }
 
-func createConfigsModelFromEnvs() configsModel {
+func createConfigsModelFromEnvs(inputs inputValues) configsModel {
 	return configsModel{
-		stfHostURL:        os.Getenv("stf_host_url"),
-		stfAccessToken:    os.Getenv("stf_access_token"),
-		deviceFilter:      getEnvOrDefault("device_filter", "."),
-		deviceNumberLimit: parseIntSafely(getEnvOrDefault("device_number_limit", "0")),
-		adbKeyPub:         os.Getenv("adb_key_pub"),
-		adbKey:            os.Getenv("adb_key"),
+		stfHostURL:     inputs.get("stf_host_url"),
+		stfAccessToken: inputs.get("stf_access_token"),
+
+		configFilePath:      os.Getenv("config_file"),
+		pool:                os.Getenv("pool"),
+		deviceNumberMinimum: parseIntSafely(inputs.get("device_number_minimum")),
+
+		deviceWaitTimeout:      parseSecondsSafely(inputs.get("device_wait_timeout")),
+		deviceWaitPollInterval: parseSecondsSafely(inputs.getOrDefault("device_wait_poll_interval", "10")),
+		deviceWaitEvents:       parseBoolSafely(inputs.get("device_wait_events")),
+		stfSessionCookie:       inputs.get("stf_session_cookie"),
+
+		remoteConnectHostRewrite: inputs.get("remote_connect_host_rewrite"),
+		remoteConnectPortOffset:  parseIntSafely(inputs.get("remote_connect_port_offset")),
+		remoteConnectPortMap:     inputs.get("remote_connect_port_map"),
+
+		adbProxyURL:         inputs.get("adb_proxy_url"),
+		adbRelayIdleTimeout: parseSecondsSafely(inputs.getOrDefault("adb_relay_idle_timeout", "60")),
+
+		stfFallbackHostURLs:     inputs.get("stf_fallback_host_urls"),
+		stfFallbackAccessTokens: inputs.get("stf_fallback_access_tokens"),
+
+		deviceFilter:      inputs.getOrDefault("device_filter", "."),
+		deviceNumberLimit: parseIntSafely(inputs.getOrDefault("device_number_limit", "0")),
+
+		minSdk:          parseIntSafely(inputs.get("min_sdk")),
+		maxSdk:          parseIntSafely(inputs.get("max_sdk")),
+		manufacturers:   parseList(inputs.get("manufacturers")),
+		modelRegex:      inputs.get("model_regex"),
+		abis:            parseList(inputs.get("abis")),
+		minDisplayWidth: parseIntSafely(inputs.get("min_display_width")),
+		providers:       parseList(inputs.get("providers")),
+		includeSerials:  parseList(inputs.get("include_serials")),
+		excludeSerials:  parseList(inputs.get("exclude_serials")),
+
+		minBatteryLevel:       parseIntSafely(inputs.get("min_battery_level")),
+		maxBatteryTemperature: parseFloatSafely(inputs.get("max_battery_temperature")),
+
+		adbKeyPub:         inputs.get("adb_key_pub"),
+		adbKey:            inputs.get("adb_key"),
+		apkPaths:          parseList(inputs.get("apk_paths")),
+		testApkPaths:      parseList(inputs.get("test_apk_paths")),
+		apkInstallOptions: inputs.getOrDefault("apk_install_options", "-r -t -g"),
+
+		reclaimOwnedDevices:    parseBoolSafely(inputs.get("reclaim_owned_devices")),
+		releaseStaleOwnedAfter: time.Duration(parseIntSafely(inputs.get("release_stale_owned_devices_after_minutes"))) * time.Minute,
+
+		cleanupPackagePrefixes:   parseList(inputs.get("cleanup_package_prefixes")),
+		cleanupClearDataPackages: parseList(inputs.get("cleanup_clear_data_packages")),
+		cleanupSdcardPath:        inputs.get("cleanup_sdcard_path"),
+
+		collectDeviceProperties: parseBoolSafely(inputs.get("collect_device_properties")),
+		deployDir:               inputs.get("deploy_dir"),
+		testResultDir:           inputs.get("test_result_dir"),
+
+		caCertificate:      inputs.get("stf_ca_certificate"),
+		clientCertificate:  inputs.get("stf_client_certificate"),
+		clientKey:          inputs.get("stf_client_key"),
+		proxyURL:           inputs.get("stf_proxy_url"),
+		noProxy:            inputs.getOrDefault("stf_no_proxy", getEnvOrDefault("NO_PROXY", os.Getenv("no_proxy"))),
+		insecureSkipVerify: parseBoolSafely(inputs.get("stf_insecure_skip_verify")),
+
+		connectTimeout: parseSecondsSafely(inputs.getOrDefault("stf_connect_timeout", "10")),
+		listTimeout:    parseSecondsSafely(inputs.getOrDefault("stf_list_timeout", "60")),
+		controlTimeout: parseSecondsSafely(inputs.getOrDefault("stf_control_timeout", "30")),
+		requestRate:    parseFloatSafely(inputs.get("stf_request_rate")),
+		verboseLog:     parseBoolSafely(inputs.get("verbose_log")),
+
+		quarantineHistoryPath: inputs.get("quarantine_history_path"),
+		quarantineFailureRate: parseFloatSafely(inputs.getOrDefault("quarantine_failure_rate", "0.5")),
+		quarantineWindow:      parseIntSafely(inputs.getOrDefault("quarantine_window", "10")),
+		quarantineMinAttempts: parseIntSafely(inputs.getOrDefault("quarantine_min_attempts", "3")),
+		quarantineCooldown:    time.Duration(parseIntSafely(inputs.getOrDefault("quarantine_cooldown_hours", "24"))) * time.Hour,
+		quarantineMode:        inputs.getOrDefault("quarantine_mode", quarantineModeSkip),
+
+		leaseLedgerPath: expandHomeDir(inputs.get("lease_ledger_path")),
+		leaseMaxAge:     time.Duration(parseIntSafely(inputs.getOrDefault("lease_max_age_hours", "24"))) * time.Hour,
+		buildSlug:       os.Getenv("BITRISE_BUILD_SLUG"),
+
+		outputFormat: inputs.getOrDefault("output_format", outputFormatAuto),
+		dotenvPath:   inputs.getOrDefault("dotenv_path", defaultDotenvPath),
+		logFormat:    inputs.getOrDefault("log_format", logFormatConsole),
 	}
 }
 
@@ -134,6 +526,37 @@ func getEnvOrDefault(key string, defaultValue string) string {
 	return value
 }
 
+// parseList splits pipe or newline separated input value into non-empty trimmed items.
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == '|' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseBoolSafely(value string) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false
+	}
+	return b
+}
+
+func parseSecondsSafely(value string) time.Duration {
+	return time.Duration(parseIntSafely(value)) * time.Second
+}
+
+func parseFloatSafely(value string) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
 func parseIntSafely(limit string) int {
 	i, err := strconv.Atoi(limit)
 	if err != nil {
@@ -144,19 +567,105 @@ func parseIntSafely(limit string) int {
 
 func (configs configsModel) dump() {
 	log.Infof("Config:")
-	log.Infof("STF host: %s", configs.stfHostURL)
+	log.Infof("STF hosts: %s", strings.Join(configs.getHostURLs(), ", "))
+	log.Infof("STF fallback hosts: %s", strings.Join(parseList(configs.stfFallbackHostURLs), ", "))
+	log.Infof("Config file: %s", configs.configFilePath)
+	log.Infof("Device pool: %s", configs.pool)
 	log.Infof("Device filter: %s", configs.deviceFilter)
+	log.Infof("Device requirements: %s", configs.describeRequirements())
+	log.Infof("Included serials: %s", strings.Join(configs.includeSerials, ", "))
+	log.Infof("Excluded serials: %s", strings.Join(configs.excludeSerials, ", "))
+	log.Infof("Reclaim owned devices: %t", configs.reclaimOwnedDevices)
+	log.Infof("Release stale owned devices after: %s", configs.releaseStaleOwnedAfter)
 	log.Infof("Device number limit: %d", configs.deviceNumberLimit)
+	log.Infof("Device number minimum: %d", configs.deviceNumberMinimum)
+	if configs.deviceWaitTimeout > 0 {
+		log.Infof("Wait for free devices: %s, poll interval: %s, STF device events: %t",
+			configs.deviceWaitTimeout, configs.deviceWaitPollInterval, configs.deviceWaitEvents)
+	}
+	log.Infof("Remote connect host rewrite rules: %s", strings.Replace(strings.TrimSpace(configs.remoteConnectHostRewrite), "\n", ", ", -1))
+	log.Infof("Remote connect port offset: %d", configs.remoteConnectPortOffset)
+	log.Infof("Remote connect port map: %s", strings.Join(parseList(configs.remoteConnectPortMap), ", "))
+	log.Infof("ADB proxy: %s", configs.adbProxyURL)
+	if configs.adbProxyURL != "" {
+		log.Infof("ADB relay idle timeout: %s", configs.adbRelayIdleTimeout)
+	}
+	log.Infof("APKs: %s", strings.Join(configs.apkPaths, ", "))
+	log.Infof("Test APKs: %s", strings.Join(configs.testApkPaths, ", "))
+	log.Infof("APK install options: %s", configs.apkInstallOptions)
+	log.Infof("Cleanup package prefixes: %s", strings.Join(configs.cleanupPackagePrefixes, ", "))
+	log.Infof("Cleanup clear data packages: %s", strings.Join(configs.cleanupClearDataPackages, ", "))
+	log.Infof("Cleanup sdcard path: %s", configs.cleanupSdcardPath)
+	log.Infof("Collect device properties: %t", configs.collectDeviceProperties)
+	log.Infof("Deploy directory: %s", configs.deployDir)
+	log.Infof("Test result directory: %s", configs.testResultDir)
+	log.Infof("STF CA certificate: %s", describePEMInput(configs.caCertificate))
+	log.Infof("STF client certificate: %s", describePEMInput(configs.clientCertificate))
+	log.Infof("STF proxy: %s", configs.proxyURL)
+	log.Infof("STF no proxy: %s", configs.noProxy)
+	log.Infof("STF insecure skip verify: %t", configs.insecureSkipVerify)
+	log.Infof("STF connect timeout: %s", configs.connectTimeout)
+	log.Infof("STF device list timeout: %s", configs.listTimeout)
+	log.Infof("STF control timeout: %s", configs.controlTimeout)
+	log.Infof("STF request rate: %g", configs.requestRate)
+	log.Infof("Quarantine history path: %s", configs.quarantineHistoryPath)
+	if configs.isQuarantineEnabled() {
+		log.Infof("Quarantine: %s devices with failure rate >= %g of last %d attempts (at least %d), cool-down: %s",
+			configs.quarantineMode, configs.quarantineFailureRate, configs.quarantineWindow, configs.quarantineMinAttempts, configs.quarantineCooldown)
+	}
+	log.Infof("Lease ledger path: %s", configs.leaseLedgerPath)
+	log.Infof("Lease maximum age: %s", configs.leaseMaxAge)
+	log.Infof("Output format: %s", configs.outputFormat)
+	log.Infof("Log format: %s", configs.logFormat)
 }
 
 func (configs *configsModel) validate() error {
-	if !strings.HasPrefix(configs.stfHostURL, "http") {
-		return fmt.Errorf("invalid STF host: %s", configs.stfHostURL)
+	if _, err := configs.getHosts(); err != nil {
+		return err
 	}
-	if configs.stfAccessToken == "" {
-		return errors.New("STF access token cannot be empty")
+	if _, err := configs.getFallbackHosts(); err != nil {
+		return err
 	}
-	return nil
+	if err := validateSerialPatterns(append(configs.includeSerials, configs.excludeSerials...)); err != nil {
+		return err
+	}
+	if err := validateQuarantineConfigs(*configs); err != nil {
+		return err
+	}
+	if configs.deviceNumberLimit > 0 && configs.deviceNumberMinimum > configs.deviceNumberLimit {
+		return fmt.Errorf("minimum device number %d is greater than limit %d", configs.deviceNumberMinimum, configs.deviceNumberLimit)
+	}
+	if configs.maxSdk > 0 && configs.minSdk > configs.maxSdk {
+		return fmt.Errorf("minimum SDK %d is greater than maximum SDK %d", configs.minSdk, configs.maxSdk)
+	}
+	if configs.collectDeviceProperties && configs.deployDir == "" {
+		return errors.New("deploy directory cannot be empty when collecting device properties")
+	}
+	if err := validateLogFormat(configs.logFormat); err != nil {
+		return err
+	}
+	if err := validateOutputFormat(*configs); err != nil {
+		return err
+	}
+	if err := validateCleanupSdcardPath(configs.cleanupSdcardPath); err != nil {
+		return err
+	}
+	if configs.connectTimeout <= 0 || configs.listTimeout <= 0 || configs.controlTimeout <= 0 {
+		return errors.New("STF timeouts have to be positive")
+	}
+	if configs.deviceWaitTimeout > 0 && configs.deviceWaitPollInterval <= 0 {
+		return errors.New("device wait poll interval has to be positive")
+	}
+	if _, err := configs.getRemoteConnectRewriter(); err != nil {
+		return err
+	}
+	if err := validateAdbProxyURL(*configs); err != nil {
+		return err
+	}
+	if configs.requestRate < 0 {
+		return errors.New("STF request rate cannot be negative")
+	}
+	return validateTransportConfigs(*configs)
 }
 
 func (configs *configsModel) isAnyAdbKeySet() bool {
@@ -171,7 +680,7 @@ func setAdbKeys(configs configsModel, homeDir string) error {
 		return err
 	}
 	if configs.isAnyAdbKeySet() {
-		return command.RunCommand("adb", "kill-server")
+		return runner.run("adb", "kill-server")
 	}
 	return nil
 }
@@ -196,22 +705,41 @@ func getHomeDir() (string, error) {
 
 func connectToAdb(remoteConnectURL string) error {
 	log.Infof("Connecting ADB to %s", remoteConnectURL)
-	output, err := command.RunCommandAndReturnCombinedStdoutAndStderr("adb", "connect", remoteConnectURL)
+	output, err := runner.runAndReturnOutput("adb", "connect", remoteConnectURL)
+	if err != nil {
+		return fmt.Errorf("%s | output: %s", err, output)
+	}
+	log.Debugf("%s", output)
+	// Older ADB versions exit with 0 even if connection could not be established.
+	for _, failure := range adbConnectFailures {
+		if strings.Contains(output, failure) {
+			return errors.New(strings.TrimSpace(output))
+		}
+	}
+	return nil
+}
+
+func runAdbOnDevice(device connectedDevice, args ...string) (string, error) {
+	return runner.runAndReturnOutput("adb", append([]string{"-s", device.remoteConnectURL}, args...)...)
+}
+
+func disconnectFromAdb(remoteConnectURL string) error {
+	output, err := runner.runAndReturnOutput("adb", "disconnect", remoteConnectURL)
 	if err != nil {
 		return err
 	}
-	log.Debugf(string(output))
+	log.Debugf("%s", output)
 	return nil
 }
 
-func getRemoteConnectURL(configs configsModel, serial string) (string, error) {
-	req, err := http.NewRequest("POST", configs.stfHostURL+userDevicesEndpoint+"/"+serial+"/remoteConnect", nil)
+func getRemoteConnectURL(configs configsModel, host stfHost, serial string) (string, error) {
+	req, err := http.NewRequest("POST", host.url+userDevicesEndpoint+"/"+serial+"/remoteConnect", nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Authorization", "Bearer "+configs.stfAccessToken)
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
 	req.Header.Set("Content-Type", "application/json")
-	response, err := client.Do(req)
+	response, err := doRequest(req, configs.controlTimeout, host.accessToken)
 	if err != nil {
 		return "", err
 	}
@@ -222,7 +750,7 @@ func getRemoteConnectURL(configs configsModel, serial string) (string, error) {
 	}()
 	bodyBytes, err := ioutil.ReadAll(response.Body)
 	if response.StatusCode != 200 {
-		return "", fmt.Errorf("request failed, status: %s | body: %s", response.Status, string(bodyBytes))
+		return "", fmt.Errorf("request failed, status: %s | body: %s", response.Status, secretRedactor.redact(string(bodyBytes)))
 	}
 	if err != nil {
 		return "", err
@@ -232,19 +760,19 @@ func getRemoteConnectURL(configs configsModel, serial string) (string, error) {
 	return remoteConnection.RemoteConnectURL, err
 }
 
-func addDeviceUnderControl(configs configsModel, serial string) error {
+func addDeviceUnderControl(configs configsModel, host stfHost, serial string) error {
 	device := &Device{Serial: serial}
 	body, err := json.Marshal(device)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", configs.stfHostURL+userDevicesEndpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", host.url+userDevicesEndpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+configs.stfAccessToken)
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
 	req.Header.Set("Content-Type", "application/json")
-	response, err := client.Do(req)
+	response, err := doRequest(req, configs.controlTimeout, host.accessToken)
 	if err != nil {
 		return err
 	}
@@ -257,17 +785,55 @@ func addDeviceUnderControl(configs configsModel, serial string) error {
 	return nil
 }
 
-func getSerials(configs configsModel) ([]string, error) {
-	req, err := http.NewRequest("GET", configs.stfHostURL+devicesEndpoint, nil)
+func removeDeviceFromControl(configs configsModel, host stfHost, serial string) error {
+	req, err := http.NewRequest("DELETE", host.url+userDevicesEndpoint+"/"+serial, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
+	response, err := doRequest(req, configs.controlTimeout, host.accessToken)
+	if err != nil {
+		return err
+	}
+	if err := response.Body.Close(); err != nil {
+		return err
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("request failed, status: %s", response.Status)
+	}
+	return nil
+}
+
+func getSerials(configs configsModel, host stfHost, ownedSerials []string) ([]string, error) {
+	serials, err := queryFreeSerials(configs, host, ownedSerials)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+configs.stfAccessToken)
+	return filterSerials(configs, serials), nil
+}
 
-	response, err := client.Do(req)
+// queryFreeSerials returns serials of present devices matching filter, which are not used or owned by STF user and listed in ownedSerials.
+// Serial include and exclude patterns are not applied.
+func queryFreeSerials(configs configsModel, host stfHost, ownedSerials []string) ([]string, error) {
+	output, err := queryDevices(configs, host, ".devices[] | select(.present and "+compileOwnerFilter(ownedSerials)+" and ("+configs.getDeviceFilter()+")) | .serial")
 	if err != nil {
 		return nil, err
 	}
+	return strings.Fields(output), nil
+}
+
+// queryDevices runs jq filter on device list of STF host.
+func queryDevices(configs configsModel, host stfHost, filter string) (string, error) {
+	req, err := http.NewRequest("GET", host.url+devicesEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
+
+	response, err := doRequest(req, configs.listTimeout, host.accessToken)
+	if err != nil {
+		return "", err
+	}
 
 	defer func() {
 		if err := response.Body.Close(); err != nil {
@@ -276,39 +842,12 @@ func getSerials(configs configsModel) ([]string, error) {
 	}()
 
 	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed, status: %s", response.Status)
+		return "", fmt.Errorf("request failed, status: %s", response.Status)
 	}
 
-	var stdout, stderr bytes.Buffer
-	cmd := command.New("jq", "-r", ".devices[] | select(.present and .owner == null and ("+configs.deviceFilter+")) | .serial")
-
-	cmd.SetStdin(response.Body)
-	cmd.SetStdout(&stdout)
-	cmd.SetStderr(&stderr)
-
-	if err = cmd.Run(); err != nil {
-		return nil, fmt.Errorf("could not create GET devices list request, error: %s | output: %s", err, stderr.String())
-	}
-
-	serials := strings.Fields(stdout.String())
-	if len(serials) == 0 {
-		return nil, fmt.Errorf("could not find present, not used devices satisfying filter: %s", configs.deviceFilter)
-	}
-	shuffleSlice(serials)
-	return serials, nil
-}
-
-func shuffleSlice(slice []string) {
-	for i := range slice {
-		j := random.Intn(i + 1)
-		slice[i], slice[j] = slice[j], slice[i]
-	}
-}
-
-func exportArrayWithEnvman(keyStr string, values []string) error {
-	body, err := json.Marshal(values)
+	stdout, stderr, err := runner.runWithInput(response.Body, "jq", "-r", filter)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("could not create GET devices list request, error: %s | output: %s", err, stderr)
 	}
-	return command.RunCommand("bitrise", "envman", "add", "--key", keyStr, "--value", string(body))
+	return stdout, nil
 }
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"errors"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"testing"
 	"time"
@@ -32,7 +32,7 @@ func TestValidateConfigNoAccessToken(t *testing.T) {
 }
 
 func TestValidateConfigNoErrors(t *testing.T) {
-	configs := configsModel{stfHostURL: "http://test.test", stfAccessToken: "test"}
+	configs := configsModel{stfHostURL: "http://test.test", stfAccessToken: "test", connectTimeout: time.Second, listTimeout: time.Second, controlTimeout: time.Second}
 	require.NoError(t, configs.validate())
 }
 
@@ -92,13 +92,11 @@ func TestSaveNonEmptyAdbKeyFail(t *testing.T) {
 }
 
 func TestSetAdbKeys(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
 	configs := configsModel{adbKey: "private", adbKeyPub: "public"}
 	fakeHomeDir, fakeAndroidUserDir := prepareFakeAndroidHomeDir(t)
 
-	require.NoError(t, exec.Command("adb", "devices").Run())
-	oldAdbPids, err := exec.Command("pgrep", "adb").CombinedOutput()
-	require.NoError(t, err)
-
 	require.NoError(t, setAdbKeys(configs, fakeHomeDir))
 
 	privateKeyFile := filepath.Join(fakeAndroidUserDir, "adbkey")
@@ -107,31 +105,40 @@ func TestSetAdbKeys(t *testing.T) {
 	publicKeyFile := filepath.Join(fakeAndroidUserDir, "adbkey.pub")
 	requireFile(t, publicKeyFile, configs.adbKeyPub, 0644)
 
-	err = retry(5, 50*time.Millisecond, func() (err error) {
-		err = exec.Command("adb", "devices").Run()
-		return
-	})
-	require.NoError(t, err)
+	require.Equal(t, []string{"adb kill-server"}, fake.callsWithPrefix("adb"))
 
-	newAdbPids, err := exec.Command("pgrep", "adb").CombinedOutput()
-	require.NoError(t, err)
-	require.NotEqual(t, string(newAdbPids), string(oldAdbPids))
+	require.NoError(t, os.RemoveAll(fakeHomeDir))
+}
+
+func TestSetAdbKeysRestartsAdbServer(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	fakeHomeDir, _ := prepareFakeAndroidHomeDir(t)
+
+	require.NoError(t, setAdbKeys(configsModel{}, fakeHomeDir))
+	require.Empty(t, fake.callsWithPrefix("adb"))
+
+	require.NoError(t, setAdbKeys(configsModel{adbKey: "private"}, fakeHomeDir))
+	require.Equal(t, []string{"adb kill-server"}, fake.callsWithPrefix("adb"))
+
+	fake.on("adb kill-server", "", errors.New("exit status 1"))
+	require.Error(t, setAdbKeys(configsModel{adbKey: "private"}, fakeHomeDir))
 
 	require.NoError(t, os.RemoveAll(fakeHomeDir))
 }
 
-func retry(attempts int, sleep time.Duration, callback func() error) (err error) {
-	for i := 0; ; i++ {
-		err = callback()
-		if err == nil {
-			return
-		}
-		if i >= (attempts - 1) {
-			break
-		}
-		time.Sleep(sleep)
-	}
-	return err
+func TestConnectToAdb(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+
+	fake.on("adb connect", "connected to device:7401", nil)
+	require.NoError(t, connectToAdb("device:7401"))
+
+	fake.on("adb connect", "failed to connect to 'device:7401': Connection refused", nil)
+	require.EqualError(t, connectToAdb("device:7401"), "failed to connect to 'device:7401': Connection refused")
+
+	fake.on("adb connect", "cannot resolve host", errors.New("exit status 1"))
+	require.Error(t, connectToAdb("device:7401"))
 }
 
 func requireFile(t *testing.T, filePath, content string, mode os.FileMode) {
@@ -165,3 +172,42 @@ func TestCalculateLimitedDeviceCount(t *testing.T) {
 	configs := configsModel{deviceNumberLimit: 1}
 	require.Equal(t, 1, calculateDeviceCount(configs, []string{"1", "2"}))
 }
+
+func TestParseList(t *testing.T) {
+	require.Nil(t, parseList(""))
+	require.Equal(t, []string{"a.apk", "b.apk", "c.apk"}, parseList(" a.apk|b.apk\n\nc.apk | "))
+}
+
+func TestGetDeviceSerials(t *testing.T) {
+	devices := []connectedDevice{{serial: "1", remoteConnectURL: "a:1"}, {serial: "2", remoteConnectURL: "b:2"}}
+	require.Equal(t, []string{"1", "2"}, getDeviceSerials(devices))
+}
+
+func TestParseBoolSafely(t *testing.T) {
+	require.True(t, parseBoolSafely("true"))
+	require.False(t, parseBoolSafely("false"))
+	require.False(t, parseBoolSafely(""))
+	require.False(t, parseBoolSafely("test"))
+}
+
+func TestValidateConfigCollectDevicePropertiesWithoutDeployDir(t *testing.T) {
+	configs := configsModel{stfHostURL: "http://test.test", stfAccessToken: "test", collectDeviceProperties: true, connectTimeout: time.Second, listTimeout: time.Second, controlTimeout: time.Second}
+	require.Error(t, configs.validate())
+	configs.deployDir = "/tmp"
+	require.NoError(t, configs.validate())
+}
+
+func TestValidateConfigNonPositiveTimeout(t *testing.T) {
+	configs := configsModel{stfHostURL: "http://test.test", stfAccessToken: "test", connectTimeout: time.Second, listTimeout: 0, controlTimeout: time.Second}
+	require.Error(t, configs.validate())
+}
+
+func TestParseSecondsSafely(t *testing.T) {
+	require.Equal(t, 5*time.Second, parseSecondsSafely("5"))
+	require.Equal(t, time.Duration(0), parseSecondsSafely("test"))
+}
+
+func TestParseFloatSafely(t *testing.T) {
+	require.Equal(t, 0.5, parseFloatSafely("0.5"))
+	require.Equal(t, 0.0, parseFloatSafely("test"))
+}
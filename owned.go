@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"time"
+)
+
+//OwnedDevice ...
+type OwnedDevice struct {
+	Serial           string     `json:"serial"`
+	UsageChangedAt   *time.Time `json:"usageChangedAt"`
+	RemoteConnectURL string     `json:"remoteConnectUrl"`
+}
+
+//OwnedDevices ...
+type OwnedDevices struct {
+	Devices []OwnedDevice `json:"devices"`
+}
+
+func (configs *configsModel) isOwnedDevicesHandlingEnabled() bool {
+	return configs.reclaimOwnedDevices || configs.releaseStaleOwnedAfter > 0
+}
+
+// prepareOwnedDevices releases devices owned by the token user for longer than configured age
+// and returns serials of the remaining owned devices, which can be reclaimed.
+// Devices leased by builds which may still be running according to lease ledger are left alone.
+func prepareOwnedDevices(configs configsModel, host stfHost, now time.Time) ([]string, error) {
+	ownedDevices, err := getOwnedDevices(configs, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not get owned devices, error: %s", err)
+	}
+	leasedSerials, err := getLiveLeaseSerials(configs, host.url, now)
+	if err != nil {
+		return nil, fmt.Errorf("could not read lease ledger, error: %s", err)
+	}
+	var ownedSerials []string
+	for _, device := range ownedDevices {
+		if containsString(leasedSerials, device.Serial) {
+			log.Infof("Device %s owned by STF user is leased by running build, skipping", device.Serial)
+			continue
+		}
+		if isStaleOwnedDevice(configs, device, now) {
+			log.Warnf("Releasing stale device %s owned since %s", device.Serial, device.UsageChangedAt.Format(time.RFC3339))
+			if err := removeDeviceFromControl(configs, host, device.Serial); err != nil {
+				log.Warnf("Could not release stale device %s, error: %s", device.Serial, err)
+			}
+			continue
+		}
+		ownedSerials = append(ownedSerials, device.Serial)
+	}
+	if !configs.reclaimOwnedDevices {
+		return nil, nil
+	}
+	return ownedSerials, nil
+}
+
+func isStaleOwnedDevice(configs configsModel, device OwnedDevice, now time.Time) bool {
+	return configs.releaseStaleOwnedAfter > 0 && device.UsageChangedAt != nil && now.Sub(*device.UsageChangedAt) > configs.releaseStaleOwnedAfter
+}
+
+func getOwnedDevices(configs configsModel, host stfHost) ([]OwnedDevice, error) {
+	req, err := http.NewRequest("GET", host.url+userDevicesEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+host.accessToken)
+	response, err := doRequest(req, configs.listTimeout, host.accessToken)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body, error: %s", err)
+		}
+	}()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("request failed, status: %s", response.Status)
+	}
+	var ownedDevices OwnedDevices
+	if err := json.NewDecoder(response.Body).Decode(&ownedDevices); err != nil {
+		return nil, err
+	}
+	return ownedDevices.Devices, nil
+}
+
+// compileOwnerFilter accepts devices not owned by anyone or owned by the token user and listed in ownedSerials.
+func compileOwnerFilter(ownedSerials []string) string {
+	if len(ownedSerials) == 0 {
+		return ".owner == null"
+	}
+	return "(.owner == null or " + compileOneOf(".serial", ownedSerials) + ")"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompileOwnerFilter(t *testing.T) {
+	require.Equal(t, ".owner == null", compileOwnerFilter(nil))
+	require.Equal(t, `(.owner == null or (.serial as $value | any("a", "b"; . == $value)))`, compileOwnerFilter([]string{"a", "b"}))
+}
+
+func TestIsStaleOwnedDevice(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	configs := configsModel{releaseStaleOwnedAfter: time.Hour}
+	require.True(t, isStaleOwnedDevice(configs, OwnedDevice{Serial: "a", UsageChangedAt: &old}, now))
+	require.False(t, isStaleOwnedDevice(configs, OwnedDevice{Serial: "a", UsageChangedAt: &now}, now))
+	require.False(t, isStaleOwnedDevice(configs, OwnedDevice{Serial: "a"}, now))
+	require.False(t, isStaleOwnedDevice(configsModel{}, OwnedDevice{Serial: "a", UsageChangedAt: &old}, now))
+}
+
+func TestGetHostCandidatesReclaimsOwnedDevices(t *testing.T) {
+	skipWithoutJQ(t)
+	var mutex sync.Mutex
+	var releasedSerials []string
+	old := time.Now().Add(-3 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == userDevicesEndpoint:
+			_, _ = w.Write([]byte(`{"devices":[{"serial":"stale","usageChangedAt":"` + old + `"},{"serial":"mine","usageChangedAt":"` + recent + `"}]}`))
+		case r.Method == "DELETE":
+			mutex.Lock()
+			releasedSerials = append(releasedSerials, r.URL.Path)
+			mutex.Unlock()
+		case r.Method == "GET" && r.URL.Path == devicesEndpoint:
+			_, _ = w.Write([]byte(`{"devices":[
+{"serial":"free","present":true,"owner":null},
+{"serial":"mine","present":true,"owner":{"email":"ci@example.com"}},
+{"serial":"other","present":true,"owner":{"email":"someone@example.com"}}
+]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := stfHost{url: server.URL, accessToken: "token"}
+	configs := configsModel{deviceFilter: ".", listTimeout: time.Second, controlTimeout: time.Second, reclaimOwnedDevices: true, releaseStaleOwnedAfter: time.Hour}
+	candidates, err := getHostCandidates(configs, host)
+	require.NoError(t, err)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].serial < candidates[j].serial })
+	require.Equal(t, []deviceCandidate{{serial: "free", host: host}, {serial: "mine", host: host, owned: true}}, candidates)
+	require.Equal(t, []string{userDevicesEndpoint + "/stale"}, releasedSerials)
+}
+
+func TestPrepareOwnedDevicesWithoutReclaim(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"devices":[{"serial":"mine"}]}`))
+	}))
+	defer server.Close()
+
+	configs := configsModel{listTimeout: time.Second, releaseStaleOwnedAfter: time.Hour}
+	ownedSerials, err := prepareOwnedDevices(configs, stfHost{url: server.URL}, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, ownedSerials)
+}
+
+func TestPrepareOwnedDevicesSkipsLeasedDevices(t *testing.T) {
+	var releasedPaths []string
+	old := time.Now().Add(-3 * time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			releasedPaths = append(releasedPaths, r.URL.Path)
+			return
+		}
+		_, _ = w.Write([]byte(`{"devices":[{"serial":"leased","usageChangedAt":"` + old + `"},{"serial":"abandoned","usageChangedAt":"` + old + `"},{"serial":"mine"}]}`))
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "stf_owned_test")
+	require.NoError(t, err)
+	configs := configsModel{listTimeout: time.Second, controlTimeout: time.Second, reclaimOwnedDevices: true, releaseStaleOwnedAfter: time.Hour,
+		leaseLedgerPath: filepath.Join(tempDir, "leases.json"), buildSlug: "current", leaseMaxAge: 24 * time.Hour}
+	host := stfHost{url: server.URL, accessToken: "token"}
+	require.NoError(t, updateLedger(configs.leaseLedgerPath, func(ledger *leaseLedger) {
+		ledger.Leases = []lease{{Host: server.URL, Serial: "leased", BuildSlug: "running", AcquiredAt: time.Now().Add(-3 * time.Hour)}}
+	}))
+
+	ownedSerials, err := prepareOwnedDevices(configs, host, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{"mine"}, ownedSerials)
+	require.Equal(t, []string{userDevicesEndpoint + "/abandoned"}, releasedPaths)
+	require.NoError(t, os.RemoveAll(tempDir))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const deviceSnapshotsSummaryFileName = "stf-devices-summary.json"
+
+var getpropLineRegexp = regexp.MustCompile(`^\[(.*)\]: \[(.*)\]$`)
+var unsafeFileNameCharsRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+type deviceSnapshot struct {
+	Serial           string            `json:"serial"`
+	RemoteConnectURL string            `json:"remoteConnectUrl"`
+	Properties       map[string]string `json:"properties"`
+	Battery          map[string]string `json:"battery"`
+	ScreenSize       string            `json:"screenSize"`
+	ScreenDensity    string            `json:"screenDensity"`
+	FreeStorageKB    int64             `json:"freeStorageKB"`
+	Errors           []string          `json:"errors,omitempty"`
+}
+
+type deviceSnapshotSummary struct {
+	Serial        string `json:"serial"`
+	Fingerprint   string `json:"fingerprint"`
+	Model         string `json:"model"`
+	SDK           string `json:"sdk"`
+	BatteryLevel  string `json:"batteryLevel"`
+	ScreenSize    string `json:"screenSize"`
+	ScreenDensity string `json:"screenDensity"`
+	FreeStorageKB int64  `json:"freeStorageKB"`
+	File          string `json:"file"`
+}
+
+// saveDeviceSnapshots writes snapshot of each device and summary of all of them into directory and returns summary path.
+func saveDeviceSnapshots(devices []connectedDevice, directory string) (string, error) {
+	snapshots := make([]deviceSnapshot, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device connectedDevice) {
+			defer wg.Done()
+			snapshots[i] = takeDeviceSnapshot(device)
+		}(i, device)
+	}
+	wg.Wait()
+
+	summaries := make([]deviceSnapshotSummary, len(snapshots))
+	for i, snapshot := range snapshots {
+		for _, snapshotErr := range snapshot.Errors {
+			log.Warnf("Device %s snapshot incomplete, error: %s", snapshot.Serial, snapshotErr)
+		}
+		fileName := "stf-device-" + unsafeFileNameCharsRegexp.ReplaceAllString(snapshot.Serial, "_") + ".json"
+		if err := writeJSONFile(filepath.Join(directory, fileName), snapshot); err != nil {
+			return "", err
+		}
+		summaries[i] = deviceSnapshotSummary{
+			Serial:        snapshot.Serial,
+			Fingerprint:   snapshot.Properties["ro.build.fingerprint"],
+			Model:         snapshot.Properties["ro.product.model"],
+			SDK:           snapshot.Properties["ro.build.version.sdk"],
+			BatteryLevel:  snapshot.Battery["level"],
+			ScreenSize:    snapshot.ScreenSize,
+			ScreenDensity: snapshot.ScreenDensity,
+			FreeStorageKB: snapshot.FreeStorageKB,
+			File:          fileName,
+		}
+	}
+	summaryPath := filepath.Join(directory, deviceSnapshotsSummaryFileName)
+	return summaryPath, writeJSONFile(summaryPath, summaries)
+}
+
+func takeDeviceSnapshot(device connectedDevice) deviceSnapshot {
+	snapshot := deviceSnapshot{Serial: device.serial, RemoteConnectURL: device.remoteConnectURL}
+	addError := func(err error) {
+		snapshot.Errors = append(snapshot.Errors, err.Error())
+	}
+
+	if output, err := runAdbShellCommand(device, "getprop"); err != nil {
+		addError(err)
+	} else {
+		snapshot.Properties = parseGetprop(output)
+	}
+	if output, err := runAdbShellCommand(device, "dumpsys", "battery"); err != nil {
+		addError(err)
+	} else {
+		snapshot.Battery = parseColonSeparatedValues(output)
+	}
+	if output, err := runAdbShellCommand(device, "wm", "size"); err != nil {
+		addError(err)
+	} else {
+		snapshot.ScreenSize = pickOverriddenValue(parseColonSeparatedValues(output), "size")
+	}
+	if output, err := runAdbShellCommand(device, "wm", "density"); err != nil {
+		addError(err)
+	} else {
+		snapshot.ScreenDensity = pickOverriddenValue(parseColonSeparatedValues(output), "density")
+	}
+	if output, err := runAdbShellCommand(device, "df", "-k", "/data"); err != nil {
+		addError(err)
+	} else if snapshot.FreeStorageKB, err = parseDfAvailableKB(output); err != nil {
+		addError(err)
+	}
+	return snapshot
+}
+
+func runAdbShellCommand(device connectedDevice, args ...string) (string, error) {
+	output, err := runAdbOnDevice(device, append([]string{"shell"}, args...)...)
+	if err != nil {
+		return "", fmt.Errorf("%s failed, error: %s | output: %s", strings.Join(args, " "), err, output)
+	}
+	return output, nil
+}
+
+func parseGetprop(output string) map[string]string {
+	properties := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		if match := getpropLineRegexp.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			properties[match[1]] = match[2]
+		}
+	}
+	return properties
+}
+
+func parseColonSeparatedValues(output string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			continue
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return values
+}
+
+// pickOverriddenValue prefers value overridden by wm over physical one.
+func pickOverriddenValue(values map[string]string, name string) string {
+	if value, ok := values["Override "+name]; ok {
+		return value
+	}
+	return values["Physical "+name]
+}
+
+func parseDfAvailableKB(output string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %s", output)
+	}
+	header := strings.Fields(lines[0])
+	values := strings.Fields(lines[len(lines)-1])
+	for i, column := range header {
+		if (column == "Available" || column == "Avail") && i < len(values) {
+			return strconv.ParseInt(values[i], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("available space not found in df output: %s", output)
+}
+
+func writeJSONFile(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(secretRedactor.redact(string(content))), 0644)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseGetprop(t *testing.T) {
+	output := "[ro.build.fingerprint]: [google/walleye/walleye:9/PQ3A/5:user/release-keys]\r\n[ro.product.model]: [Pixel 2]\n[empty]: []\ngarbage\n"
+	require.Equal(t, map[string]string{
+		"ro.build.fingerprint": "google/walleye/walleye:9/PQ3A/5:user/release-keys",
+		"ro.product.model":     "Pixel 2",
+		"empty":                "",
+	}, parseGetprop(output))
+}
+
+func TestParseColonSeparatedValues(t *testing.T) {
+	output := "Current Battery Service state:\n  AC powered: false\n  level: 85\n  temperature: 250\n"
+	require.Equal(t, map[string]string{"AC powered": "false", "level": "85", "temperature": "250"}, parseColonSeparatedValues(output))
+}
+
+func TestPickOverriddenValue(t *testing.T) {
+	require.Equal(t, "1080x1920", pickOverriddenValue(parseColonSeparatedValues("Physical size: 1080x1920\n"), "size"))
+	require.Equal(t, "320", pickOverriddenValue(parseColonSeparatedValues("Physical density: 420\nOverride density: 320\n"), "density"))
+}
+
+func TestParseDfAvailableKB(t *testing.T) {
+	output := "Filesystem     1K-blocks    Used Available Use% Mounted on\n/dev/block/dm-2  24912332 9875540  14905720  40% /data\n"
+	available, err := parseDfAvailableKB(output)
+	require.NoError(t, err)
+	require.Equal(t, int64(14905720), available)
+
+	_, err = parseDfAvailableKB("Filesystem Size Used Free Blksize\n/data 12.1G 4.2G 7.9G 4096\n")
+	require.Error(t, err)
+	_, err = parseDfAvailableKB("")
+	require.Error(t, err)
+}
+
+func TestWriteJSONFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_properties_test")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "snapshot.json")
+
+	require.NoError(t, writeJSONFile(path, deviceSnapshot{Serial: "serial", FreeStorageKB: 1}))
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var snapshot deviceSnapshot
+	require.NoError(t, json.Unmarshal(content, &snapshot))
+	require.Equal(t, "serial", snapshot.Serial)
+	require.Equal(t, int64(1), snapshot.FreeStorageKB)
+	require.NoError(t, os.RemoveAll(tempDir))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	quarantineModeSkip         = "skip"
+	quarantineModeDeprioritize = "deprioritize"
+)
+
+type deviceAttempt struct {
+	Time   time.Time `json:"time"`
+	Failed bool      `json:"failed"`
+}
+
+type quarantineHistory struct {
+	Devices map[string][]deviceAttempt `json:"devices"`
+}
+
+func (configs *configsModel) isQuarantineEnabled() bool {
+	return configs.quarantineHistoryPath != ""
+}
+
+func validateQuarantineConfigs(configs configsModel) error {
+	if !configs.isQuarantineEnabled() {
+		return nil
+	}
+	if configs.quarantineMode != quarantineModeSkip && configs.quarantineMode != quarantineModeDeprioritize {
+		return fmt.Errorf("invalid quarantine mode: %s", configs.quarantineMode)
+	}
+	if configs.quarantineFailureRate <= 0 || configs.quarantineFailureRate > 1 {
+		return fmt.Errorf("quarantine failure rate has to be in (0, 1] range: %g", configs.quarantineFailureRate)
+	}
+	if configs.quarantineWindow < 1 || configs.quarantineMinAttempts < 1 || configs.quarantineMinAttempts > configs.quarantineWindow {
+		return fmt.Errorf("quarantine minimum attempts (%d) has to be positive and not greater than window (%d)", configs.quarantineMinAttempts, configs.quarantineWindow)
+	}
+	return nil
+}
+
+func quarantineKey(host stfHost, serial string) string {
+	return host.url + "|" + serial
+}
+
+// loadQuarantineHistory returns empty history if file does not exist yet.
+func loadQuarantineHistory(path string) (*quarantineHistory, error) {
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{}}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, history); err != nil {
+		return nil, fmt.Errorf("could not parse %s, error: %s", path, err)
+	}
+	if history.Devices == nil {
+		history.Devices = map[string][]deviceAttempt{}
+	}
+	return history, nil
+}
+
+func (history *quarantineHistory) save(path string) error {
+	content, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, content)
+}
+
+// writeFileAtomically writes content to temporary file first and renames it, so concurrent readers never see partially written file.
+func writeFileAtomically(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// record appends attempt result, keeping only attempts within window.
+func (history *quarantineHistory) record(key string, failed bool, now time.Time, window int) {
+	if history == nil {
+		return
+	}
+	attempts := append(history.Devices[key], deviceAttempt{Time: now, Failed: failed})
+	if len(attempts) > window {
+		attempts = attempts[len(attempts)-window:]
+	}
+	history.Devices[key] = attempts
+}
+
+func (history *quarantineHistory) failureRate(key string) (float64, int) {
+	attempts := history.Devices[key]
+	if len(attempts) == 0 {
+		return 0, 0
+	}
+	failures := 0
+	for _, attempt := range attempts {
+		if attempt.Failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(attempts)), len(attempts)
+}
+
+func (history *quarantineHistory) lastFailureTime(key string) time.Time {
+	var lastFailure time.Time
+	for _, attempt := range history.Devices[key] {
+		if attempt.Failed && attempt.Time.After(lastFailure) {
+			lastFailure = attempt.Time
+		}
+	}
+	return lastFailure
+}
+
+// applyQuarantine skips or moves to the end candidates which recently failed too often.
+// Devices which have not failed for cool-down period are paroled and their history is cleared.
+func applyQuarantine(configs configsModel, history *quarantineHistory, candidates []deviceCandidate, now time.Time) []deviceCandidate {
+	var trustedCandidates, quarantinedCandidates []deviceCandidate
+	for _, candidate := range candidates {
+		key := quarantineKey(candidate.host, candidate.serial)
+		rate, attempts := history.failureRate(key)
+		if attempts < configs.quarantineMinAttempts || rate < configs.quarantineFailureRate {
+			trustedCandidates = append(trustedCandidates, candidate)
+			continue
+		}
+		if now.Sub(history.lastFailureTime(key)) >= configs.quarantineCooldown {
+			log.Printf("Device %s from %s paroled after cool-down period", candidate.serial, candidate.host.url)
+			delete(history.Devices, key)
+			trustedCandidates = append(trustedCandidates, candidate)
+			continue
+		}
+		log.Printf("Device %s from %s quarantined, failure rate: %.0f%% of %d recent attempts", candidate.serial, candidate.host.url, rate*100, attempts)
+		quarantinedCandidates = append(quarantinedCandidates, candidate)
+	}
+	if configs.quarantineMode == quarantineModeDeprioritize {
+		return append(trustedCandidates, quarantinedCandidates...)
+	}
+	return trustedCandidates
+}
+
+// countUsableCandidates returns number of candidates which applyQuarantine would not skip, without logging or paroling them.
+func countUsableCandidates(configs configsModel, history *quarantineHistory, candidates []deviceCandidate, now time.Time) int {
+	if history == nil || configs.quarantineMode == quarantineModeDeprioritize {
+		return len(candidates)
+	}
+	count := 0
+	for _, candidate := range candidates {
+		key := quarantineKey(candidate.host, candidate.serial)
+		rate, attempts := history.failureRate(key)
+		if attempts < configs.quarantineMinAttempts || rate < configs.quarantineFailureRate || now.Sub(history.lastFailureTime(key)) >= configs.quarantineCooldown {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateQuarantineConfigs(t *testing.T) {
+	configs := configsModel{quarantineHistoryPath: "history.json", quarantineMode: quarantineModeSkip, quarantineFailureRate: 0.5, quarantineWindow: 10, quarantineMinAttempts: 3}
+	require.NoError(t, validateQuarantineConfigs(configs))
+	require.NoError(t, validateQuarantineConfigs(configsModel{}))
+
+	invalidMode := configs
+	invalidMode.quarantineMode = "ignore"
+	require.Error(t, validateQuarantineConfigs(invalidMode))
+
+	invalidRate := configs
+	invalidRate.quarantineFailureRate = 0
+	require.Error(t, validateQuarantineConfigs(invalidRate))
+
+	invalidAttempts := configs
+	invalidAttempts.quarantineMinAttempts = 11
+	require.Error(t, validateQuarantineConfigs(invalidAttempts))
+}
+
+func TestQuarantineHistoryRecordKeepsWindow(t *testing.T) {
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{}}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		history.record("key", i < 3, now, 3)
+	}
+	rate, attempts := history.failureRate("key")
+	require.Equal(t, 3, attempts)
+	require.InDelta(t, 1.0/3, rate, 0.001)
+
+	var nilHistory *quarantineHistory
+	nilHistory.record("key", true, now, 3)
+}
+
+func TestQuarantineHistorySaveAndLoad(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stf_quarantine_test")
+	require.NoError(t, err)
+	path := filepath.Join(tempDir, "cache", "history.json")
+
+	history, err := loadQuarantineHistory(path)
+	require.NoError(t, err)
+	require.Empty(t, history.Devices)
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	history.record("key", true, now, 10)
+	require.NoError(t, history.save(path))
+
+	loadedHistory, err := loadQuarantineHistory(path)
+	require.NoError(t, err)
+	require.Equal(t, history.Devices, loadedHistory.Devices)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	_, err = loadQuarantineHistory(path)
+	require.Error(t, err)
+
+	require.NoError(t, os.RemoveAll(tempDir))
+}
+
+func TestApplyQuarantine(t *testing.T) {
+	host := stfHost{url: "https://stf.example.com"}
+	now := time.Now()
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{
+		quarantineKey(host, "flaky"):     {{Time: now.Add(-time.Hour), Failed: true}, {Time: now.Add(-time.Hour), Failed: true}, {Time: now, Failed: false}},
+		quarantineKey(host, "paroled"):   {{Time: now.Add(-48 * time.Hour), Failed: true}, {Time: now.Add(-48 * time.Hour), Failed: true}},
+		quarantineKey(host, "new-flaky"): {{Time: now, Failed: true}},
+	}}
+	candidates := []deviceCandidate{{serial: "flaky", host: host}, {serial: "paroled", host: host}, {serial: "new-flaky", host: host}, {serial: "stable", host: host}}
+	configs := configsModel{quarantineMode: quarantineModeSkip, quarantineFailureRate: 0.5, quarantineWindow: 10, quarantineMinAttempts: 2, quarantineCooldown: 24 * time.Hour}
+
+	require.Equal(t, []string{"paroled", "new-flaky", "stable"}, getCandidateSerials(applyQuarantine(configs, history, candidates, now)))
+	require.NotContains(t, history.Devices, quarantineKey(host, "paroled"))
+
+	configs.quarantineMode = quarantineModeDeprioritize
+	require.Equal(t, []string{"paroled", "new-flaky", "stable", "flaky"}, getCandidateSerials(applyQuarantine(configs, history, candidates, now)))
+}
+
+func TestCountUsableCandidates(t *testing.T) {
+	host := stfHost{url: "https://stf.example.com"}
+	now := time.Now()
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{
+		quarantineKey(host, "flaky"):   {{Time: now.Add(-time.Hour), Failed: true}, {Time: now.Add(-time.Hour), Failed: true}},
+		quarantineKey(host, "paroled"): {{Time: now.Add(-48 * time.Hour), Failed: true}, {Time: now.Add(-48 * time.Hour), Failed: true}},
+	}}
+	candidates := []deviceCandidate{{serial: "flaky", host: host}, {serial: "paroled", host: host}, {serial: "stable", host: host}}
+	configs := configsModel{quarantineMode: quarantineModeSkip, quarantineFailureRate: 0.5, quarantineWindow: 10, quarantineMinAttempts: 2, quarantineCooldown: 24 * time.Hour}
+
+	require.Equal(t, 2, countUsableCandidates(configs, history, candidates, now))
+	require.Contains(t, history.Devices, quarantineKey(host, "paroled"))
+	require.Equal(t, 3, countUsableCandidates(configs, nil, candidates, now))
+	configs.quarantineMode = quarantineModeDeprioritize
+	require.Equal(t, 3, countUsableCandidates(configs, history, candidates, now))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limited STF requests are retried at most this many times, waiting at most maxRetryAfter each time.
+const maxRateLimitRetries = 5
+const maxRetryAfter = time.Minute
+
+// Wait before retrying rate limited request without Retry-After header, doubled with each retry.
+const defaultRetryAfter = time.Second
+
+// requestLimiter is shared by all device workers, nil means requests are not limited.
+var requestLimiter *tokenBucket
+
+// tokenBucket allows rate requests per second on average and bursts of up to rate requests, at least one.
+type tokenBucket struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Floor(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, updated: time.Now()}
+}
+
+// reserve takes token and returns how long caller has to wait before using it.
+func (bucket *tokenBucket) reserve(now time.Time) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if now.After(bucket.updated) {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.rate)
+		bucket.updated = now
+	}
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// getRetryAfter returns wait requested by Retry-After header of rate limited response,
+// either in seconds or as HTTP date, falling back to exponential backoff.
+func getRetryAfter(response *http.Response, retry int, now time.Time) time.Duration {
+	wait := defaultRetryAfter << uint(retry)
+	value := strings.TrimSpace(response.Header.Get("Retry-After"))
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = date.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+func sleepWithContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
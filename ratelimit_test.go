@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	require.Nil(t, newTokenBucket(0))
+	require.Equal(t, time.Duration(0), (*tokenBucket)(nil).reserve(time.Now()))
+
+	now := time.Now()
+	bucket := newTokenBucket(2)
+	bucket.updated = now
+	require.Equal(t, time.Duration(0), bucket.reserve(now))
+	require.Equal(t, time.Duration(0), bucket.reserve(now))
+	require.Equal(t, 500*time.Millisecond, bucket.reserve(now))
+	require.Equal(t, time.Second, bucket.reserve(now))
+	require.Equal(t, 500*time.Millisecond, bucket.reserve(now.Add(time.Second)))
+	require.Equal(t, time.Duration(0), bucket.reserve(now.Add(5*time.Second)))
+}
+
+func TestTokenBucketReserveFractionalRate(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(0.5)
+	bucket.updated = now
+	require.Equal(t, time.Duration(0), bucket.reserve(now))
+	require.Equal(t, 2*time.Second, bucket.reserve(now))
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newResponse := func(retryAfter string) *http.Response {
+		response := &http.Response{Header: http.Header{}}
+		if retryAfter != "" {
+			response.Header.Set("Retry-After", retryAfter)
+		}
+		return response
+	}
+
+	require.Equal(t, 3*time.Second, getRetryAfter(newResponse("3"), 0, now))
+	require.Equal(t, 7*time.Second, getRetryAfter(newResponse(now.Add(7*time.Second).Format(http.TimeFormat)), 0, now))
+	require.Equal(t, time.Duration(0), getRetryAfter(newResponse(now.Add(-time.Hour).Format(http.TimeFormat)), 0, now))
+	require.Equal(t, maxRetryAfter, getRetryAfter(newResponse("3600"), 0, now))
+	require.Equal(t, defaultRetryAfter, getRetryAfter(newResponse(""), 0, now))
+	require.Equal(t, 4*defaultRetryAfter, getRetryAfter(newResponse("soon"), 2, now))
+}
+
+func TestDoRequestRetriesRateLimited(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+	stats := requestStats
+	requestStats = &requestStatsModel{}
+	defer func() {
+		requestStats = stats
+	}()
+
+	req, err := http.NewRequest("POST", server.URL, bytes.NewBufferString("payload"))
+	require.NoError(t, err)
+	response, err := doRequest(req, time.Second, "token")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+	rateLimitedCount, _ := requestStats.throttling()
+	require.Equal(t, 2, rateLimitedCount)
+}
+
+func TestDoRequestGivesUpRateLimited(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	response, err := doRequest(req, time.Second, "token")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	require.Equal(t, maxRateLimitRetries+1, requests)
+}
+
+func TestDoRequestThrottledByLimiter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	requestLimiter = newTokenBucket(20)
+	defer func() {
+		requestLimiter = nil
+	}()
+
+	startTime := time.Now()
+	for i := 0; i < 25; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(t, err)
+		response, err := doRequest(req, time.Second, "token")
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+	}
+	require.True(t, time.Since(startTime) >= 200*time.Millisecond)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redactedPlaceholder = "[REDACTED]"
+
+// Shorter values are not treated as secrets, masking them would garble unrelated text.
+const minSecretLength = 4
+
+var (
+	authorizationPattern = regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*["']?)((?:bearer|basic|token)\s+)?[^\s"',;]+`)
+	privateKeyPattern    = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`)
+)
+
+// redactor masks secrets in all the text written by the step: logs, errors, reports and exported outputs.
+type redactor struct {
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+var secretRedactor = &redactor{}
+
+// addSecret registers secret value. Multiline values e.g. keys are also masked line by line, so their fragments do not leak.
+func (r *redactor) addSecret(secret string) {
+	values := []string{strings.TrimSpace(secret)}
+	if strings.Contains(values[0], "\n") {
+		for _, line := range strings.Split(values[0], "\n") {
+			if line = strings.TrimSpace(line); !strings.HasPrefix(line, "-----") {
+				values = append(values, line)
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, value := range values {
+		if len(value) >= minSecretLength && !containsString(r.secrets, value) {
+			r.secrets = append(r.secrets, value)
+		}
+	}
+	// Longer secrets first, so that secret containing another one is masked as a whole.
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+func (r *redactor) redact(text string) string {
+	text = privateKeyPattern.ReplaceAllString(text, redactedPlaceholder)
+	text = authorizationPattern.ReplaceAllString(text, "${1}${2}"+redactedPlaceholder)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, secret := range r.secrets {
+		text = strings.Replace(text, secret, redactedPlaceholder, -1)
+	}
+	return text
+}
+
+// registerSecrets makes STF access tokens and private keys from configs masked.
+func registerSecrets(configs configsModel) {
+	for _, token := range append(parseList(configs.stfAccessToken), parseList(configs.stfFallbackAccessTokens)...) {
+		secretRedactor.addSecret(token)
+	}
+	for _, cookie := range parseList(configs.stfSessionCookie) {
+		secretRedactor.addSecret(cookie)
+	}
+	secretRedactor.addSecret(configs.adbKey)
+	registerProxyPassword(configs.proxyURL)
+	registerProxyPassword(configs.adbProxyURL)
+	if strings.Contains(configs.clientKey, pemBlockPrefix) {
+		secretRedactor.addSecret(configs.clientKey)
+	}
+}
+
+// redactingWriter masks secrets in everything written through it. Each write is expected to contain whole message.
+type redactingWriter struct {
+	writer io.Writer
+}
+
+func (writer redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(writer.writer, secretRedactor.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactingExporter masks secrets in exported output values.
+type redactingExporter struct {
+	exporter outputExporter
+}
+
+func (exporter redactingExporter) export(key, value string) error {
+	return exporter.exporter.export(key, secretRedactor.redact(value))
+}
+
+func (exporter redactingExporter) flush() error {
+	return exporter.exporter.flush()
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const relayCommandName = "relay"
+
+const (
+	socks5Version            = 0x05
+	socks5NoAuthentication   = 0x00
+	socks5UserPassword       = 0x02
+	socks5NoAcceptableMethod = 0xFF
+	socks5CommandConnect     = 0x01
+	socks5AddressIPv4        = 0x01
+	socks5AddressDomain      = 0x03
+	socks5AddressIPv6        = 0x04
+)
+
+// newRelayCommand creates command starting relay process, it is the step executable itself running relay subcommand.
+var newRelayCommand = func(target string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(executable, relayCommandName, target), nil
+}
+
+func validateAdbProxyURL(configs configsModel) error {
+	if configs.adbProxyURL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(configs.adbProxyURL)
+	if err != nil || proxyURL.Host == "" {
+		return errors.New("invalid ADB proxy URL")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported ADB proxy URL scheme: %s, supported schemes: http, https, socks5, socks5h", proxyURL.Scheme)
+	}
+	if configs.adbRelayIdleTimeout <= 0 {
+		return errors.New("ADB relay idle timeout has to be positive")
+	}
+	return nil
+}
+
+// startRelay spawns detached relay process tunneling local port to target through ADB proxy and returns local address.
+// Relay outlives the step and exits once ADB has been disconnected from it for idle timeout.
+func startRelay(configs configsModel, target string) (string, error) {
+	cmd, err := newRelayCommand(target)
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = getRelayEnvironment()
+	// Settings are written to standard input, environment of relay would be readable from /proc for as long as it runs.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	// New session, so relay is not stopped along with the step.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	// Relay outlives the step, so its log goes to file rather than pipe nobody reads once the step exits.
+	logPath := getRelayLogPath(target)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not create relay log, error: %s", err)
+	}
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if closeErr := logFile.Close(); closeErr != nil {
+		log.Warnf("Could not close relay log, error: %s", closeErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not start relay, error: %s", err)
+	}
+	err = json.NewEncoder(stdin).Encode(getRelaySettings(configs))
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		stopRelay(cmd)
+		return "", fmt.Errorf("could not pass settings to relay, error: %s", err)
+	}
+
+	addresses := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		addresses <- strings.TrimSpace(line)
+	}()
+	var address string
+	select {
+	case address = <-addresses:
+	case <-time.After(configs.connectTimeout):
+	}
+	if address == "" {
+		stopRelay(cmd)
+		output, _ := ioutil.ReadFile(logPath)
+		return "", fmt.Errorf("relay did not start, output: %s", strings.TrimSpace(string(output)))
+	}
+	if err := stdout.Close(); err != nil {
+		log.Warnf("Could not close relay output, error: %s", err)
+	}
+	pid := cmd.Process.Pid
+	if err := cmd.Process.Release(); err != nil {
+		log.Warnf("Could not detach relay, error: %s", err)
+	}
+	log.Infof("Relaying %s to %s through ADB proxy, relay PID: %d, log: %s", address, target, pid, logPath)
+	return address, nil
+}
+
+// stopRelay kills relay which did not start and waits for it to exit.
+func stopRelay(cmd *exec.Cmd) {
+	if err := cmd.Process.Kill(); err != nil {
+		log.Warnf("Could not stop relay, error: %s", err)
+	}
+	_ = cmd.Wait()
+}
+
+// getRelaySettings returns step inputs relay is configured with.
+func getRelaySettings(configs configsModel) inputValues {
+	return inputValues{
+		"adb_proxy_url":            configs.adbProxyURL,
+		"adb_relay_idle_timeout":   strconv.Itoa(int(configs.adbRelayIdleTimeout / time.Second)),
+		"stf_connect_timeout":      strconv.Itoa(int(configs.connectTimeout / time.Second)),
+		"stf_ca_certificate":       configs.caCertificate,
+		"stf_client_certificate":   configs.clientCertificate,
+		"stf_client_key":           configs.clientKey,
+		"stf_insecure_skip_verify": strconv.FormatBool(configs.insecureSkipVerify),
+		"log_format":               configs.logFormat,
+	}
+}
+
+// getRelayEnvironment returns environment of the step without step inputs, which hold secrets like access tokens and keys.
+func getRelayEnvironment() []string {
+	inputNames := map[string]bool{}
+	for _, input := range cliInputs {
+		inputNames[input.name] = true
+	}
+	var environment []string
+	for _, variable := range os.Environ() {
+		if !inputNames[strings.SplitN(variable, "=", 2)[0]] {
+			environment = append(environment, variable)
+		}
+	}
+	return environment
+}
+
+// getRelayLogPath returns path of relay log in temp directory. Deploy directory is uploaded as build artifacts, so it is not used.
+func getRelayLogPath(target string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, target)
+	return filepath.Join(os.TempDir(), "adb-relay-"+name+".log")
+}
+
+// runRelayCommand listens on random local port, prints its address and relays connections to target given in args.
+func runRelayCommand(configs configsModel, args []string, output io.Writer) int {
+	// Output carries relay address only.
+	logOutput = os.Stderr
+	// Settings written by startRelay, environment and flags still take precedence.
+	var settings inputValues
+	if err := json.NewDecoder(os.Stdin).Decode(&settings); err != nil {
+		setLogFormat(configs.logFormat)
+		log.Errorf("Could not read relay settings, error: %s", err)
+		return 1
+	}
+	configs = createConfigsModelFromEnvs(settings)
+	registerSecrets(configs)
+	setLogFormat(configs.logFormat)
+	if len(args) != 1 {
+		log.Errorf("Expected single relay target address, got: %s", strings.Join(args, " "))
+		return 1
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		log.Errorf("Invalid relay target address %s, error: %s", args[0], err)
+		return 1
+	}
+	if configs.adbProxyURL == "" {
+		log.Errorf("Could not validate config, error: ADB proxy URL is not set")
+		return 1
+	}
+	if err := validateAdbProxyURL(configs); err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	proxyURL, err := url.Parse(configs.adbProxyURL)
+	if err != nil {
+		log.Errorf("Could not validate config, error: %s", err)
+		return 1
+	}
+	// TLS settings of STF client apply to HTTPS ADB proxy too.
+	transport, err := createHTTPTransport(configs)
+	if err != nil {
+		log.Errorf("Could not configure TLS, error: %s", err)
+		return 1
+	}
+	client.Transport = transport
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Errorf("Could not start relay, error: %s", err)
+		return 11
+	}
+	if _, err := fmt.Fprintln(output, listener.Addr().String()); err != nil {
+		return 11
+	}
+
+	target := args[0]
+	dial := func() (net.Conn, error) {
+		return dialThroughProxy(proxyURL, target, configs.connectTimeout)
+	}
+	if err := serveRelay(listener, dial, configs.adbRelayIdleTimeout); err != nil {
+		return 11
+	}
+	return 0
+}
+
+// serveRelay relays accepted connections to ones opened by dial, until there is no connection for idle timeout.
+func serveRelay(listener net.Listener, dial func() (net.Conn, error), idleTimeout time.Duration) error {
+	connections := make(chan net.Conn)
+	acceptErrs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErrs <- err
+				return
+			}
+			connections <- conn
+		}
+	}()
+
+	finished := make(chan struct{})
+	active := 0
+	idleTimer := time.NewTimer(idleTimeout)
+	defer idleTimer.Stop()
+	for {
+		select {
+		case conn := <-connections:
+			active++
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			go func() {
+				relayConnection(conn, dial)
+				finished <- struct{}{}
+			}()
+		case <-finished:
+			if active--; active == 0 {
+				idleTimer.Reset(idleTimeout)
+			}
+		case <-idleTimer.C:
+			if active == 0 {
+				return listener.Close()
+			}
+		case err := <-acceptErrs:
+			return err
+		}
+	}
+}
+
+// relayConnection copies data both ways until either side closes connection, then closes the other one too.
+func relayConnection(conn net.Conn, dial func() (net.Conn, error)) {
+	upstream, err := dial()
+	if err != nil {
+		_ = conn.Close()
+		log.Warnf("Could not connect through ADB proxy, error: %s", err)
+		return
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		_ = conn.Close()
+		_ = upstream.Close()
+	}
+	var wg sync.WaitGroup
+	for _, pair := range [][2]net.Conn{{upstream, conn}, {conn, upstream}} {
+		wg.Add(1)
+		go func(destination, source net.Conn) {
+			defer wg.Done()
+			_, _ = io.Copy(destination, source)
+			once.Do(closeBoth)
+		}(pair[0], pair[1])
+	}
+	wg.Wait()
+}
+
+// dialThroughProxy opens connection to target address through HTTP CONNECT or SOCKS5 proxy.
+// Target host name is resolved locally for socks5 scheme and by proxy for socks5h, like curl does.
+func dialThroughProxy(proxyURL *url.URL, target string, timeout time.Duration) (net.Conn, error) {
+	if proxyURL.Scheme == "socks5" {
+		resolvedTarget, err := resolveTarget(target, timeout)
+		if err != nil {
+			return nil, err
+		}
+		target = resolvedTarget
+	}
+	conn, err := net.DialTimeout("tcp", getProxyAddress(proxyURL), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConfig := &tls.Config{}
+		if clientTLSConfig := getClientTLSConfig(); clientTLSConfig != nil {
+			tlsConfig = clientTLSConfig.Clone()
+		}
+		tlsConfig.ServerName = proxyURL.Hostname()
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, describeTLSError(err)
+		}
+		conn = tlsConn
+	}
+
+	var tunnel net.Conn
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		tunnel, err = socks5Connect(conn, proxyURL.User, target)
+	} else {
+		tunnel, err = httpConnect(conn, proxyURL.User, target)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// resolveTarget replaces host name of target address with its IP address, preferring IPv4 one.
+func resolveTarget(target string, timeout time.Duration) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return target, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	ip := addresses[0].IP
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			ip = address.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+func getProxyAddress(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	defaultPort := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[proxyURL.Scheme]
+	return net.JoinHostPort(proxyURL.Hostname(), defaultPort)
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, target string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed, status: %s", target, response.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn returns data proxy sent right after its response, already buffered by response reader, before reading further.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// socks5Connect performs SOCKS5 handshake, see RFC 1928 and RFC 1929 for username/password authentication.
+func socks5Connect(conn net.Conn, user *url.Userinfo, target string) (net.Conn, error) {
+	host, portValue, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := parsePort(portValue)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5NoAuthentication)
+	if user != nil {
+		method = socks5UserPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] == socks5NoAcceptableMethod || reply[1] != method {
+		return nil, errors.New("SOCKS5 proxy does not accept authentication method")
+	}
+	if method == socks5UserPassword {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return nil, errors.New("SOCKS5 username or password too long")
+		}
+		request := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		request = append(append(request, byte(len(password))), password...)
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, errors.New("SOCKS5 proxy authentication failed")
+		}
+	}
+
+	request := []byte{socks5Version, socks5CommandConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, socks5AddressIPv4), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, socks5AddressIPv6), ip.To16()...)
+	} else if len(host) <= 255 {
+		request = append(append(request, socks5AddressDomain, byte(len(host))), host...)
+	} else {
+		return nil, errors.New("SOCKS5 target host name too long")
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("SOCKS5 proxy CONNECT to %s failed, reply code: %d", target, header[1])
+	}
+	var addressLength int
+	switch header[3] {
+	case socks5AddressIPv4:
+		addressLength = net.IPv4len
+	case socks5AddressIPv6:
+		addressLength = net.IPv6len
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		addressLength = int(length[0])
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS5 address type: %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addressLength+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// registerProxyPassword masks password of proxy URL in both decoded and URL encoded form.
+func registerProxyPassword(proxyURL string) {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil || parsedURL.User == nil {
+		return
+	}
+	if password, ok := parsedURL.User.Password(); ok {
+		secretRedactor.addSecret(password)
+		userInfo := parsedURL.User.String()
+		secretRedactor.addSecret(userInfo[strings.Index(userInfo, ":")+1:])
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// getDeviceFilter combines jq device filter with structured device requirements.
+func (configs *configsModel) getDeviceFilter() string {
+	requirements := configs.compileRequirements()
+	if len(requirements) == 0 {
+		return configs.deviceFilter
+	}
+	return "(" + configs.deviceFilter + ") and " + strings.Join(requirements, " and ")
+}
+
+func (configs *configsModel) compileRequirements() []string {
+	var requirements []string
+	if configs.minSdk > 0 {
+		requirements = append(requirements, compileSdkRequirement(">=", configs.minSdk))
+	}
+	if configs.maxSdk > 0 {
+		requirements = append(requirements, compileSdkRequirement("<=", configs.maxSdk))
+	}
+	if len(configs.manufacturers) > 0 {
+		requirements = append(requirements, compileOneOf("(.manufacturer // \"\" | ascii_downcase)", toLowerCase(configs.manufacturers)))
+	}
+	if configs.modelRegex != "" {
+		requirements = append(requirements, fmt.Sprintf("(.model // \"\" | test(%s))", toJQString(configs.modelRegex)))
+	}
+	if len(configs.abis) > 0 {
+		requirements = append(requirements, compileOneOf("(.abi // \"\")", configs.abis))
+	}
+	if configs.minDisplayWidth > 0 {
+		requirements = append(requirements, fmt.Sprintf("(.display.width // 0) >= %d", configs.minDisplayWidth))
+	}
+	if len(configs.providers) > 0 {
+		requirements = append(requirements, compileOneOf("(.provider.name // \"\")", configs.providers))
+	}
+	if configs.minBatteryLevel > 0 {
+		requirements = append(requirements, fmt.Sprintf("((.battery.level // 0) * 100 / ((.battery.scale // 100) | if . > 0 then . else 100 end)) >= %d", configs.minBatteryLevel))
+	}
+	if configs.maxBatteryTemperature > 0 {
+		requirements = append(requirements, fmt.Sprintf("(.battery.temp // 0) <= %g", configs.maxBatteryTemperature))
+	}
+	if configs.isBatteryCheckEnabled() {
+		requirements = append(requirements, "("+compileOneOf("(.battery.health // \"\")", badBatteryHealths)+" | not)")
+	}
+	return requirements
+}
+
+// compileSdkRequirement compares SDK with given operator. Devices with missing or non-numeric SDK e.g. preview "S" never match.
+func compileSdkRequirement(operator string, sdk int) string {
+	return fmt.Sprintf("(((.sdk | tonumber?) // null) as $sdk | $sdk != null and $sdk %s %d)", operator, sdk)
+}
+
+func (configs *configsModel) describeRequirements() string {
+	var descriptions []string
+	if configs.minSdk > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("SDK >= %d", configs.minSdk))
+	}
+	if configs.maxSdk > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("SDK <= %d", configs.maxSdk))
+	}
+	if len(configs.manufacturers) > 0 {
+		descriptions = append(descriptions, "manufacturer one of: "+strings.Join(configs.manufacturers, ", "))
+	}
+	if configs.modelRegex != "" {
+		descriptions = append(descriptions, "model matching: "+configs.modelRegex)
+	}
+	if len(configs.abis) > 0 {
+		descriptions = append(descriptions, "ABI one of: "+strings.Join(configs.abis, ", "))
+	}
+	if configs.minDisplayWidth > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("display width >= %d", configs.minDisplayWidth))
+	}
+	if len(configs.providers) > 0 {
+		descriptions = append(descriptions, "provider one of: "+strings.Join(configs.providers, ", "))
+	}
+	if configs.minBatteryLevel > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("battery level >= %d%%", configs.minBatteryLevel))
+	}
+	if configs.maxBatteryTemperature > 0 {
+		descriptions = append(descriptions, fmt.Sprintf("battery temperature <= %g°C", configs.maxBatteryTemperature))
+	}
+	if configs.isBatteryCheckEnabled() {
+		descriptions = append(descriptions, "battery health not one of: "+strings.Join(badBatteryHealths, ", "))
+	}
+	if len(descriptions) == 0 {
+		return "none"
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+func compileOneOf(value string, allowedValues []string) string {
+	jqValues := make([]string, len(allowedValues))
+	for i, allowedValue := range allowedValues {
+		jqValues[i] = toJQString(allowedValue)
+	}
+	return fmt.Sprintf("(%s as $value | any(%s; . == $value))", value, strings.Join(jqValues, ", "))
+}
+
+func toJQString(value string) string {
+	literal, _ := json.Marshal(value)
+	return string(literal)
+}
+
+func toLowerCase(values []string) []string {
+	lowerCaseValues := make([]string, len(values))
+	for i, value := range values {
+		lowerCaseValues[i] = strings.ToLower(value)
+	}
+	return lowerCaseValues
+}
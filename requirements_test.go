@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const requirementsTestDevices = `{"devices":[
+{"serial":"pixel","sdk":"30","manufacturer":"Google","model":"Pixel 4","abi":"arm64-v8a","display":{"width":1080},"provider":{"name":"office"}},
+{"serial":"galaxy","sdk":"9","manufacturer":"SAMSUNG","model":"GT-I9000","abi":"armeabi-v7a","display":{"width":480},"provider":{"name":"office"}},
+{"serial":"emulator","sdk":"25","manufacturer":"unknown","model":"Android SDK built for x86","abi":"x86","display":{"width":1440},"provider":{"name":"dc"}},
+{"serial":"incomplete"}
+]}`
+
+func TestGetDeviceFilterWithoutRequirements(t *testing.T) {
+	configs := configsModel{deviceFilter: "."}
+	require.Equal(t, ".", configs.getDeviceFilter())
+	require.Equal(t, []string{"pixel", "galaxy", "emulator", "incomplete"}, filterTestDevices(t, configs))
+}
+
+func TestGetDeviceFilterNumericSdk(t *testing.T) {
+	require.Equal(t, []string{"pixel", "emulator"}, filterTestDevices(t, configsModel{deviceFilter: ".", minSdk: 21}))
+	require.Equal(t, []string{"galaxy", "emulator"}, filterTestDevices(t, configsModel{deviceFilter: ".", maxSdk: 25}))
+}
+
+func TestGetDeviceFilterUnknownSdk(t *testing.T) {
+	devices := `{"devices":[{"serial":"preview","sdk":"S"},{"serial":"empty","sdk":""},{"serial":"missing"},{"serial":"numeric","sdk":28}]}`
+	require.Equal(t, []string{"numeric"}, filterDevices(t, configsModel{deviceFilter: ".", maxSdk: 30}, devices))
+	require.Equal(t, []string{"numeric"}, filterDevices(t, configsModel{deviceFilter: ".", minSdk: 21}, devices))
+}
+
+func TestGetDeviceFilterManufacturersCaseInsensitive(t *testing.T) {
+	configs := configsModel{deviceFilter: ".", manufacturers: []string{"samsung", "Google"}}
+	require.Equal(t, []string{"pixel", "galaxy"}, filterTestDevices(t, configs))
+}
+
+func TestGetDeviceFilterCombined(t *testing.T) {
+	configs := configsModel{
+		deviceFilter:    `.provider.name == "office"`,
+		modelRegex:      "^(Pixel|GT-)",
+		abis:            []string{"arm64-v8a", "x86"},
+		minDisplayWidth: 720,
+		providers:       []string{"office", "dc"},
+	}
+	require.Equal(t, []string{"pixel"}, filterTestDevices(t, configs))
+}
+
+func TestDescribeRequirements(t *testing.T) {
+	require.Equal(t, "none", (&configsModel{}).describeRequirements())
+	configs := configsModel{minSdk: 21, maxSdk: 30, manufacturers: []string{"Google"}, modelRegex: "^Pixel", abis: []string{"x86"}, minDisplayWidth: 720, providers: []string{"office"}}
+	require.Equal(t, "SDK >= 21; SDK <= 30; manufacturer one of: Google; model matching: ^Pixel; ABI one of: x86; display width >= 720; provider one of: office", configs.describeRequirements())
+	batteryConfigs := configsModel{minBatteryLevel: 20, maxBatteryTemperature: 40.5}
+	require.Equal(t, "battery level >= 20%; battery temperature <= 40.5°C; battery health not one of: overheat, dead, over_voltage, cold, unspecified_failure", batteryConfigs.describeRequirements())
+}
+
+func TestToJQString(t *testing.T) {
+	require.Equal(t, `"a \"quoted\" \\d"`, toJQString(`a "quoted" \d`))
+}
+
+func filterTestDevices(t *testing.T, configs configsModel) []string {
+	return filterDevices(t, configs, requirementsTestDevices)
+}
+
+func filterDevices(t *testing.T, configs configsModel, devices string) []string {
+	skipWithoutJQ(t)
+	cmd := exec.Command("jq", "-r", ".devices[] | select("+configs.getDeviceFilter()+") | .serial")
+	cmd.Stdin = strings.NewReader(devices)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	return strings.Fields(string(output))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const hostRewriteSeparator = "=>"
+
+type hostRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// remoteConnectRewriter maps remote connect URLs reported by STF to addresses reachable by ADB, e.g. through NAT.
+type remoteConnectRewriter struct {
+	hostRules  []hostRewriteRule
+	portOffset int
+	portMap    map[int]int
+}
+
+type deviceAddress struct {
+	RemoteConnectURL string `json:"remoteConnectUrl"`
+	ADBAddress       string `json:"adbAddress"`
+}
+
+func (configs configsModel) getRemoteConnectRewriter() (remoteConnectRewriter, error) {
+	hostRules, err := parseHostRewriteRules(configs.remoteConnectHostRewrite)
+	if err != nil {
+		return remoteConnectRewriter{}, err
+	}
+	portMap, err := parsePortMap(configs.remoteConnectPortMap)
+	if err != nil {
+		return remoteConnectRewriter{}, err
+	}
+	return remoteConnectRewriter{hostRules: hostRules, portOffset: configs.remoteConnectPortOffset, portMap: portMap}, nil
+}
+
+// parseHostRewriteRules parses rules in "regex => replacement" format, one per line.
+func parseHostRewriteRules(value string) ([]hostRewriteRule, error) {
+	var rules []hostRewriteRule
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		separatorIndex := strings.LastIndex(line, hostRewriteSeparator)
+		if separatorIndex < 0 {
+			return nil, fmt.Errorf("invalid host rewrite rule %s, expected format: regex %s replacement", line, hostRewriteSeparator)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(line[:separatorIndex]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host rewrite rule %s, error: %s", line, err)
+		}
+		rules = append(rules, hostRewriteRule{pattern: pattern, replacement: strings.TrimSpace(line[separatorIndex+len(hostRewriteSeparator):])})
+	}
+	return rules, nil
+}
+
+// parsePortMap parses "from:to" port pairs.
+func parsePortMap(value string) (map[int]int, error) {
+	portMap := map[int]int{}
+	for _, entry := range parseList(value) {
+		ports := strings.Split(entry, ":")
+		if len(ports) != 2 {
+			return nil, fmt.Errorf("invalid port mapping %s, expected format: from:to", entry)
+		}
+		from, fromErr := parsePort(ports[0])
+		to, toErr := parsePort(ports[1])
+		if fromErr != nil || toErr != nil {
+			return nil, fmt.Errorf("invalid port mapping %s, ports have to be between 1 and 65535", entry)
+		}
+		portMap[from] = to
+	}
+	return portMap, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port out of range: %d", port)
+	}
+	return port, nil
+}
+
+func (rewriter remoteConnectRewriter) isEnabled() bool {
+	return len(rewriter.hostRules) > 0 || rewriter.portOffset != 0 || len(rewriter.portMap) > 0
+}
+
+// rewrite applies the first host rule matching host of remote connect URL and then either port mapping or,
+// if port is not mapped, port offset.
+func (rewriter remoteConnectRewriter) rewrite(remoteConnectURL string) (string, error) {
+	if !rewriter.isEnabled() {
+		return remoteConnectURL, nil
+	}
+	host, portValue, err := net.SplitHostPort(remoteConnectURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse remote connect URL %s, error: %s", remoteConnectURL, err)
+	}
+	for _, rule := range rewriter.hostRules {
+		if rule.pattern.MatchString(host) {
+			host = rule.pattern.ReplaceAllString(host, rule.replacement)
+			break
+		}
+	}
+	port, err := parsePort(portValue)
+	if err != nil {
+		return "", fmt.Errorf("could not parse remote connect URL %s, error: %s", remoteConnectURL, err)
+	}
+	if mappedPort, ok := rewriter.portMap[port]; ok {
+		port = mappedPort
+	} else if port += rewriter.portOffset; port < 1 || port > 65535 {
+		return "", fmt.Errorf("port of remote connect URL %s out of range after offset %d", remoteConnectURL, rewriter.portOffset)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+func exportDeviceAddresses(exporter outputExporter, keyStr string, devices []connectedDevice) error {
+	addresses := map[string]deviceAddress{}
+	for _, device := range devices {
+		addresses[device.serial] = deviceAddress{RemoteConnectURL: device.stfRemoteConnectURL, ADBAddress: device.remoteConnectURL}
+	}
+	body, err := json.Marshal(addresses)
+	if err != nil {
+		return err
+	}
+	return exporter.export(keyStr, string(body))
+}
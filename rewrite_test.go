@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseHostRewriteRules(t *testing.T) {
+	rules, err := parseHostRewriteRules("\n ^provider-(\\d+)\\.internal$ => stf-$1.example.com \n^a|b$=>c\n")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "^provider-(\\d+)\\.internal$", rules[0].pattern.String())
+	require.Equal(t, "stf-$1.example.com", rules[0].replacement)
+	require.Equal(t, "^a|b$", rules[1].pattern.String())
+
+	_, err = parseHostRewriteRules("provider.internal")
+	require.Error(t, err)
+	_, err = parseHostRewriteRules("provider(.internal => host")
+	require.Error(t, err)
+}
+
+func TestParsePortMap(t *testing.T) {
+	portMap, err := parsePortMap("7401:27001 | 7403:27003")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int{7401: 27001, 7403: 27003}, portMap)
+
+	for _, value := range []string{"7401", "7401:", "7401:70000", "a:1", "1:2:3"} {
+		_, err := parsePortMap(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestRemoteConnectRewriterRewrite(t *testing.T) {
+	configs := configsModel{
+		remoteConnectHostRewrite: "^provider-(\\d+)\\.internal$ => stf-$1.example.com\n^provider-.*$ => fallback.example.com",
+		remoteConnectPortOffset:  10000,
+		remoteConnectPortMap:     "7401:27001",
+	}
+	rewriter, err := configs.getRemoteConnectRewriter()
+	require.NoError(t, err)
+
+	for original, expected := range map[string]string{
+		"provider-3.internal:7401": "stf-3.example.com:27001",
+		"provider-3.internal:7403": "stf-3.example.com:17403",
+		"provider-x.internal:7405": "fallback.example.com:17405",
+		"10.0.0.1:7407":            "10.0.0.1:17407",
+		"[fd00::1]:7409":           "[fd00::1]:17409",
+	} {
+		rewritten, err := rewriter.rewrite(original)
+		require.NoError(t, err)
+		require.Equal(t, expected, rewritten, original)
+	}
+
+	_, err = rewriter.rewrite("provider-3.internal")
+	require.Error(t, err)
+	rewriter.portOffset = 60000
+	_, err = rewriter.rewrite("provider-3.internal:7403")
+	require.Error(t, err)
+}
+
+func TestRemoteConnectRewriterDisabled(t *testing.T) {
+	rewriter, err := configsModel{}.getRemoteConnectRewriter()
+	require.NoError(t, err)
+	rewritten, err := rewriter.rewrite("not an address")
+	require.NoError(t, err)
+	require.Equal(t, "not an address", rewritten)
+}
+
+func TestExportDeviceAddresses(t *testing.T) {
+	exporter := &jsonExporter{values: map[string]string{}}
+	devices := []connectedDevice{{serial: "a", remoteConnectURL: "nat.example.com:17401", stfRemoteConnectURL: "provider.internal:7401"}}
+	require.NoError(t, exportDeviceAddresses(exporter, "KEY", devices))
+	require.JSONEq(t, `{"a":{"remoteConnectUrl":"provider.internal:7401","adbAddress":"nat.example.com:17401"}}`, exporter.values["KEY"])
+}
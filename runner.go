@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+)
+
+// commandRunner runs external tools (adb, jq, bitrise), so that the flow can be exercised without them being installed.
+type commandRunner interface {
+	// run runs command with output forwarded to the step log.
+	run(name string, args ...string) error
+	// runAndReturnOutput runs command and returns its combined stdout and stderr.
+	runAndReturnOutput(name string, args ...string) (string, error)
+	// runWithInput runs command with given stdin and returns its stdout and stderr separately.
+	runWithInput(input io.Reader, name string, args ...string) (string, string, error)
+}
+
+type goUtilsCommandRunner struct{}
+
+var runner commandRunner = goUtilsCommandRunner{}
+
+// run logs command output instead of passing it to standard output, so it is formatted and its secrets are masked like the rest of log.
+func (goUtilsCommandRunner) run(name string, args ...string) error {
+	output, err := command.RunCommandAndReturnCombinedStdoutAndStderr(name, args...)
+	if output != "" {
+		log.Printf("%s", output)
+	}
+	return err
+}
+
+func (goUtilsCommandRunner) runAndReturnOutput(name string, args ...string) (string, error) {
+	return command.RunCommandAndReturnCombinedStdoutAndStderr(name, args...)
+}
+
+func (goUtilsCommandRunner) runWithInput(input io.Reader, name string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := command.New(name, args...)
+	cmd.SetStdin(input)
+	cmd.SetStdout(&stdout)
+	cmd.SetStderr(&stderr)
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeCommandResult struct {
+	output string
+	err    error
+}
+
+// fakeCommandRunner records executed commands and responds with programmed results.
+// Result of the longest programmed command line prefix wins, unprogrammed commands succeed with no output
+// unless their tool is passed through to the real runner.
+type fakeCommandRunner struct {
+	mutex       sync.Mutex
+	results     map[string]fakeCommandResult
+	passThrough map[string]bool
+	calls       []string
+}
+
+// skipWithoutJQ skips test which lists STF devices, as device lists are filtered by real jq.
+func skipWithoutJQ(t *testing.T) {
+	if _, err := exec.LookPath("jq"); err != nil {
+		t.Skip("jq is not available")
+	}
+}
+
+func useFakeCommandRunner() (*fakeCommandRunner, func()) {
+	fake := &fakeCommandRunner{results: map[string]fakeCommandResult{}, passThrough: map[string]bool{}}
+	previous := runner
+	runner = fake
+	return fake, func() { runner = previous }
+}
+
+func (fake *fakeCommandRunner) on(commandLinePrefix, output string, err error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.results[commandLinePrefix] = fakeCommandResult{output: output, err: err}
+}
+
+func (fake *fakeCommandRunner) passThroughTool(name string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.passThrough[name] = true
+}
+
+func (fake *fakeCommandRunner) callsWithPrefix(prefix string) []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var calls []string
+	for _, call := range fake.calls {
+		if strings.HasPrefix(call, prefix) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (fake *fakeCommandRunner) execute(name string, args []string) (fakeCommandResult, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	commandLine := strings.Join(append([]string{name}, args...), " ")
+	fake.calls = append(fake.calls, commandLine)
+	if fake.passThrough[name] {
+		return fakeCommandResult{}, false
+	}
+	var result fakeCommandResult
+	longestPrefix := -1
+	for prefix, programmed := range fake.results {
+		if strings.HasPrefix(commandLine, prefix) && len(prefix) > longestPrefix {
+			result, longestPrefix = programmed, len(prefix)
+		}
+	}
+	return result, true
+}
+
+func (fake *fakeCommandRunner) run(name string, args ...string) error {
+	if result, handled := fake.execute(name, args); handled {
+		return result.err
+	}
+	return goUtilsCommandRunner{}.run(name, args...)
+}
+
+func (fake *fakeCommandRunner) runAndReturnOutput(name string, args ...string) (string, error) {
+	if result, handled := fake.execute(name, args); handled {
+		return result.output, result.err
+	}
+	return goUtilsCommandRunner{}.runAndReturnOutput(name, args...)
+}
+
+func (fake *fakeCommandRunner) runWithInput(input io.Reader, name string, args ...string) (string, string, error) {
+	if result, handled := fake.execute(name, args); handled {
+		if _, err := ioutil.ReadAll(input); err != nil {
+			return "", "", err
+		}
+		if result.err != nil {
+			return "", result.output, result.err
+		}
+		return result.output, "", nil
+	}
+	return goUtilsCommandRunner{}.runWithInput(input, name, args...)
+}
+
+func TestGoUtilsCommandRunnerWithInput(t *testing.T) {
+	stdout, stderr, err := goUtilsCommandRunner{}.runWithInput(strings.NewReader("input"), "sh", "-c", "cat; echo error >&2")
+	require.NoError(t, err)
+	require.Equal(t, "input", stdout)
+	require.Equal(t, "error\n", stderr)
+}
+
+func TestGoUtilsCommandRunnerOutput(t *testing.T) {
+	output, err := goUtilsCommandRunner{}.runAndReturnOutput("sh", "-c", "echo out; echo error >&2; exit 3")
+	require.Error(t, err)
+	require.Equal(t, "out\nerror", output)
+}
+
+func TestGoUtilsCommandRunnerLogsOutput(t *testing.T) {
+	const secret = "runner-secret-token"
+	secretRedactor.addSecret(secret)
+	var logs bytes.Buffer
+	logOutput = &logs
+	setLogFormat(logFormatJSON)
+	defer func() {
+		logOutput = os.Stdout
+		setLogFormat(logFormatConsole)
+	}()
+
+	require.NoError(t, goUtilsCommandRunner{}.run("sh", "-c", "echo 100% "+secret+"; echo error >&2"))
+	var entry jsonLogEntry
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	require.Equal(t, "100% [REDACTED]\nerror", entry.Message)
+}
+
+func TestFakeCommandRunnerLongestPrefixWins(t *testing.T) {
+	fake, restore := useFakeCommandRunner()
+	defer restore()
+	fake.on("adb", "generic", nil)
+	fake.on("adb connect", "connected", nil)
+	fake.on("adb connect broken", "", errors.New("exit status 1"))
+
+	output, err := runner.runAndReturnOutput("adb", "connect", "device:7401")
+	require.NoError(t, err)
+	require.Equal(t, "connected", output)
+	_, err = runner.runAndReturnOutput("adb", "connect", "broken:7401")
+	require.Error(t, err)
+	output, err = runner.runAndReturnOutput("adb", "devices")
+	require.NoError(t, err)
+	require.Equal(t, "generic", output)
+	require.Equal(t, []string{"adb connect device:7401", "adb connect broken:7401"}, fake.callsWithPrefix("adb connect"))
+}
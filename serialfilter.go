@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"path"
+)
+
+// filterSerials applies include and exclude glob patterns to serials, logging every rejected device.
+func filterSerials(configs configsModel, serials []string) []string {
+	var filteredSerials []string
+	for _, serial := range serials {
+		if rejection := getSerialRejection(configs, serial); rejection != "" {
+			log.Printf("Device %s %s", serial, rejection)
+			continue
+		}
+		filteredSerials = append(filteredSerials, serial)
+	}
+	return filteredSerials
+}
+
+// getSerialRejection returns why serial is rejected by include and exclude patterns or empty string if it is accepted.
+func getSerialRejection(configs configsModel, serial string) string {
+	if pattern, ok := matchAnyPattern(serial, configs.excludeSerials); ok {
+		return "excluded by pattern: " + pattern
+	}
+	if len(configs.includeSerials) > 0 {
+		if _, ok := matchAnyPattern(serial, configs.includeSerials); !ok {
+			return "excluded, not matching any of included serials"
+		}
+	}
+	return ""
+}
+
+func matchAnyPattern(serial string, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, serial); err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func validateSerialPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid serial pattern: %s", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFilterSerialsNoPatterns(t *testing.T) {
+	require.Equal(t, []string{"a", "b"}, filterSerials(configsModel{}, []string{"a", "b"}))
+}
+
+func TestFilterSerialsExclude(t *testing.T) {
+	configs := configsModel{excludeSerials: []string{"emulator-*", "BROKEN1"}}
+	require.Equal(t, []string{"R58M", "BROKEN10"}, filterSerials(configs, []string{"emulator-5554", "R58M", "BROKEN1", "BROKEN10"}))
+}
+
+func TestFilterSerialsInclude(t *testing.T) {
+	configs := configsModel{includeSerials: []string{"R58?", "CB*"}, excludeSerials: []string{"CB2"}}
+	require.Equal(t, []string{"R58M", "CB1"}, filterSerials(configs, []string{"emulator-5554", "R58M", "CB1", "CB2"}))
+}
+
+func TestValidateSerialPatterns(t *testing.T) {
+	require.NoError(t, validateSerialPatterns([]string{"R58*", "CB[0-9]"}))
+	require.Error(t, validateSerialPatterns([]string{"CB[0-9"}))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/bitrise-io/go-utils/log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const slowestRequestsCount = 3
+
+type requestRecord struct {
+	method   string
+	path     string
+	status   string
+	duration time.Duration
+}
+
+type requestStatsModel struct {
+	mutex            sync.Mutex
+	records          []requestRecord
+	throttled        time.Duration
+	rateLimitedCount int
+}
+
+var requestStats = &requestStatsModel{}
+
+func (stats *requestStatsModel) record(req *http.Request, response *http.Response, duration time.Duration, accessToken string) {
+	record := requestRecord{
+		method:   req.Method,
+		path:     describeRequestPath(req, accessToken),
+		status:   "no response",
+		duration: duration,
+	}
+	if response != nil {
+		record.status = response.Status
+	}
+	log.Debugf("STF %s %s -> %s in %s", record.method, record.path, record.status, record.duration)
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.records = append(stats.records, record)
+}
+
+// recordThrottling adds time spent waiting for client-side limit or, if rateLimited, for rate limited request retry.
+func (stats *requestStatsModel) recordThrottling(wait time.Duration, rateLimited bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.throttled += wait
+	if rateLimited {
+		stats.rateLimitedCount++
+	}
+}
+
+func (stats *requestStatsModel) throttling() (int, time.Duration) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.rateLimitedCount, stats.throttled
+}
+
+func (stats *requestStatsModel) slowest(count int) []requestRecord {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	records := append([]requestRecord(nil), stats.records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].duration > records[j].duration
+	})
+	if len(records) > count {
+		records = records[:count]
+	}
+	return records
+}
+
+func (stats *requestStatsModel) total() (int, time.Duration) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	var totalDuration time.Duration
+	for _, record := range stats.records {
+		totalDuration += record.duration
+	}
+	return len(stats.records), totalDuration
+}
+
+func (stats *requestStatsModel) dump() {
+	count, totalDuration := stats.total()
+	if count == 0 {
+		return
+	}
+	log.Infof("STF requests: %d, total time: %s", count, totalDuration)
+	if rateLimitedCount, throttled := stats.throttling(); throttled > 0 || rateLimitedCount > 0 {
+		log.Warnf("STF throttling: %d rate limited responses, total wait: %s", rateLimitedCount, throttled)
+	}
+	log.Infof("Slowest STF requests:")
+	for _, record := range stats.slowest(slowestRequestsCount) {
+		log.Printf("- %s %s -> %s in %s", record.method, record.path, record.status, record.duration)
+	}
+}
+
+func describeRequestPath(req *http.Request, accessToken string) string {
+	path := req.URL.Host + req.URL.Path
+	if accessToken != "" {
+		path = strings.Replace(path, accessToken, redactedPlaceholder, -1)
+	}
+	return secretRedactor.redact(path)
+}
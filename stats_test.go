@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestStatsSlowest(t *testing.T) {
+	stats := &requestStatsModel{}
+	stats.record(httptest.NewRequest("GET", "/api/v1/devices", nil), &http.Response{Status: "200 OK"}, 3*time.Second, "token")
+	stats.record(httptest.NewRequest("POST", "/api/v1/user/devices", nil), nil, time.Second, "token")
+	stats.record(httptest.NewRequest("POST", "/api/v1/user/devices/token/remoteConnect", nil), &http.Response{Status: "200 OK"}, 2*time.Second, "token")
+
+	slowest := stats.slowest(2)
+	require.Equal(t, []requestRecord{
+		{method: "GET", path: "/api/v1/devices", status: "200 OK", duration: 3 * time.Second},
+		{method: "POST", path: "/api/v1/user/devices/[REDACTED]/remoteConnect", status: "200 OK", duration: 2 * time.Second},
+	}, slowest)
+
+	count, totalDuration := stats.total()
+	require.Equal(t, 3, count)
+	require.Equal(t, 6*time.Second, totalDuration)
+	require.Equal(t, "no response", stats.slowest(3)[2].status)
+}
+
+func TestDoRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	_, err = doRequest(req, 50*time.Millisecond, "token")
+	require.Error(t, err)
+
+	response, err := doRequest(req, time.Second, "token")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const pemBlockPrefix = "-----BEGIN"
+
+func validateTransportConfigs(configs configsModel) error {
+	if (configs.clientCertificate == "") != (configs.clientKey == "") {
+		return errors.New("STF client certificate and key have to be set together")
+	}
+	if configs.proxyURL != "" {
+		proxyURL, err := url.Parse(configs.proxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("invalid STF proxy URL: %s", configs.proxyURL)
+		}
+	}
+	return nil
+}
+
+func describePEMInput(value string) string {
+	if value == "" {
+		return ""
+	}
+	if strings.Contains(value, pemBlockPrefix) {
+		return "<PEM contents>"
+	}
+	return value
+}
+
+// readPEMInput returns value itself if it contains PEM block, otherwise treats it as file path.
+func readPEMInput(value string) ([]byte, error) {
+	if strings.Contains(value, pemBlockPrefix) {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+func createHTTPTransport(configs configsModel) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: configs.connectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = configs.connectTimeout
+	tlsConfig := &tls.Config{InsecureSkipVerify: configs.insecureSkipVerify}
+	if configs.insecureSkipVerify {
+		log.Warnf("STF TLS certificate verification is disabled")
+	}
+
+	if configs.caCertificate != "" {
+		caPEM, err := readPEMInput(configs.caCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate, error: %s", err)
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no valid certificates found in CA bundle")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if configs.clientCertificate != "" {
+		certificatePEM, err := readPEMInput(configs.clientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client certificate, error: %s", err)
+		}
+		keyPEM, err := readPEMInput(configs.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client key, error: %s", err)
+		}
+		certificate, err := tls.X509KeyPair(certificatePEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate or key, error: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if configs.proxyURL != "" {
+		proxyURL, err := url.Parse(configs.proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		noProxy := parseNoProxy(configs.noProxy)
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if isProxyBypassed(req.URL, noProxy) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+	return transport, nil
+}
+
+func parseNoProxy(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// isProxyBypassed matches URL against NO_PROXY entries: "*", IP addresses, CIDR ranges and domains (including subdomains), optionally with port.
+func isProxyBypassed(requestURL *url.URL, noProxy []string) bool {
+	host := strings.ToLower(requestURL.Hostname())
+	port := requestURL.Port()
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entryHost = h
+		}
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// doRequest performs STF API request which, including reading response body, has to finish within timeout.
+// Requests are throttled by requestLimiter and rate limited ones are retried after wait requested by STF.
+func doRequest(req *http.Request, timeout time.Duration, accessToken string) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		wait := requestLimiter.reserve(time.Now())
+		requestStats.recordThrottling(wait, false)
+		if err := sleepWithContext(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		response, err := doRequestAttempt(req, timeout, accessToken)
+		if err != nil || response.StatusCode != http.StatusTooManyRequests || retry >= maxRateLimitRetries {
+			return response, err
+		}
+
+		retryAfter := getRetryAfter(response, retry, time.Now())
+		if err := response.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body, error: %s", err)
+		}
+		log.Warnf("STF rate limited %s %s, retrying in %s", req.Method, describeRequestPath(req, accessToken), retryAfter)
+		requestStats.recordThrottling(retryAfter, true)
+		if err := sleepWithContext(req.Context(), retryAfter); err != nil {
+			return nil, err
+		}
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rewindRequest returns copy of already sent request with fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("could not rewind request body, error: %s", err)
+	}
+	rewound := req.Clone(req.Context())
+	rewound.Body = body
+	return rewound, nil
+}
+
+func doRequestAttempt(req *http.Request, timeout time.Duration, accessToken string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	startTime := time.Now()
+	response, err := client.Do(req.WithContext(ctx))
+	requestStats.record(req, response, time.Since(startTime), accessToken)
+	if err != nil {
+		cancel()
+		return nil, describeTLSError(err)
+	}
+	response.Body = &cancelOnCloseBody{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnCloseBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+// describeTLSError adds hints to errors caused by failed TLS handshake.
+func describeTLSError(err error) error {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		return fmt.Errorf("TLS handshake failed, STF certificate is signed by unknown authority, set CA certificate input to trust it, error: %s", err)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("TLS handshake failed, STF certificate is not valid for host, error: %s", err)
+	case errors.As(err, &certificateInvalidErr):
+		return fmt.Errorf("TLS handshake failed, STF certificate is invalid, error: %s", err)
+	case errors.As(err, &recordHeaderErr):
+		return fmt.Errorf("TLS handshake failed, server does not speak TLS, check STF host URL scheme and proxy, error: %s", err)
+	case strings.Contains(err.Error(), "remote error: tls:"):
+		return fmt.Errorf("TLS handshake rejected by server, check client certificate and key, error: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestValidateTransportConfigs(t *testing.T) {
+	require.NoError(t, validateTransportConfigs(configsModel{}))
+	require.Error(t, validateTransportConfigs(configsModel{clientCertificate: "cert.pem"}))
+	require.Error(t, validateTransportConfigs(configsModel{clientKey: "key.pem"}))
+	require.NoError(t, validateTransportConfigs(configsModel{clientCertificate: "cert.pem", clientKey: "key.pem"}))
+	require.Error(t, validateTransportConfigs(configsModel{proxyURL: "proxy"}))
+	require.NoError(t, validateTransportConfigs(configsModel{proxyURL: "http://proxy:3128"}))
+}
+
+func TestIsProxyBypassed(t *testing.T) {
+	noProxy := parseNoProxy("localhost, .internal.example.com,10.0.0.0/8, stf.example.com:8443,*.corp")
+	bypassed := func(rawURL string) bool {
+		requestURL, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		return isProxyBypassed(requestURL, noProxy)
+	}
+	require.True(t, bypassed("http://localhost:7100"))
+	require.True(t, bypassed("https://stf.internal.example.com"))
+	require.True(t, bypassed("https://internal.example.com"))
+	require.True(t, bypassed("http://10.1.2.3"))
+	require.True(t, bypassed("https://stf.example.com:8443"))
+	require.True(t, bypassed("https://stf.corp"))
+	require.False(t, bypassed("https://stf.example.com"))
+	require.False(t, bypassed("https://external.com"))
+	require.False(t, bypassed("http://192.168.1.1"))
+	require.True(t, isProxyBypassed(&url.URL{Host: "any"}, parseNoProxy("*")))
+}
+
+func TestCreateHTTPTransportProxy(t *testing.T) {
+	transport, err := createHTTPTransport(configsModel{proxyURL: "http://proxy:3128", noProxy: "localhost"})
+	require.NoError(t, err)
+
+	proxyURL, err := transport.Proxy(httptest.NewRequest("GET", "https://stf.example.com/api/v1/devices", nil))
+	require.NoError(t, err)
+	require.Equal(t, "proxy:3128", proxyURL.Host)
+
+	proxyURL, err = transport.Proxy(httptest.NewRequest("GET", "http://localhost/api/v1/devices", nil))
+	require.NoError(t, err)
+	require.Nil(t, proxyURL)
+}
+
+func TestCreateHTTPTransportInvalidCA(t *testing.T) {
+	_, err := createHTTPTransport(configsModel{caCertificate: "-----BEGIN CERTIFICATE-----\ninvalid\n-----END CERTIFICATE-----"})
+	require.Error(t, err)
+	_, err = createHTTPTransport(configsModel{caCertificate: "/non/existent/ca.pem"})
+	require.Error(t, err)
+}
+
+func TestDoRequestCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	defer func(transport http.RoundTripper) { client.Transport = transport }(client.Transport)
+
+	transport, err := createHTTPTransport(configsModel{})
+	require.NoError(t, err)
+	client.Transport = transport
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	_, err = doRequest(req, time.Second, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown authority")
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	transport, err = createHTTPTransport(configsModel{caCertificate: string(caPEM)})
+	require.NoError(t, err)
+	client.Transport = transport
+	response, err := doRequest(req, time.Second, "")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, 200, response.StatusCode)
+
+	transport, err = createHTTPTransport(configsModel{insecureSkipVerify: true})
+	require.NoError(t, err)
+	client.Transport = transport
+	response, err = doRequest(req, time.Second, "")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/bitrise-io/go-utils/log"
+	"time"
+)
+
+// getCandidatesWaiting gets candidates like getCandidatesWithFallback, but if wait timeout is set and there are not enough
+// free devices not skipped by quarantine, listing is repeated until they are or timeout passes. Devices are listed again every
+// poll interval and, if device events are enabled, right after any STF host reports device change over websocket.
+func getCandidatesWaiting(configs configsModel, primaryHosts, fallbackHosts []stfHost, history *quarantineHistory) ([]deviceCandidate, []stfHost, error) {
+	candidates, usedHosts, err := getCandidatesWithFallback(configs, primaryHosts, fallbackHosts)
+	required := configs.getRequiredDeviceNumber()
+	if configs.deviceWaitTimeout <= 0 || (err == nil && countUsableCandidates(configs, history, candidates, time.Now()) >= required) {
+		return candidates, usedHosts, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configs.deviceWaitTimeout)
+	defer cancel()
+	changes := make(chan struct{}, 1)
+	if configs.deviceWaitEvents {
+		for _, host := range append(append([]stfHost{}, primaryHosts...), fallbackHosts...) {
+			go func(host stfHost) {
+				if err := listenDeviceEvents(ctx, configs, host, changes); err != nil {
+					log.Warnf("Could not receive device events from %s, falling back to polling, error: %s", host.url, err)
+				}
+			}(host)
+		}
+	}
+	ticker := time.NewTicker(configs.deviceWaitPollInterval)
+	defer ticker.Stop()
+	listHost := newRefreshingHostLister(candidates)
+
+	for {
+		log.Infof("Waiting for free devices, found: %d, required: %d", countUsableCandidates(configs, history, candidates, time.Now()), required)
+		select {
+		case <-changes:
+			log.Debugf("STF reported device change")
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warnf("Free devices not found within %s", configs.deviceWaitTimeout)
+			return candidates, usedHosts, err
+		}
+		candidates, usedHosts, err = listCandidatesWithFallback(configs, primaryHosts, fallbackHosts, listHost, true)
+		if err != nil {
+			log.Debugf("Could not get devices, error: %s", err)
+		} else if countUsableCandidates(configs, history, candidates, time.Now()) >= required {
+			return candidates, usedHosts, err
+		}
+	}
+}
+
+// newRefreshingHostLister returns lister which only lists devices again, without side effects of getHostCandidates repeated:
+// owned devices are neither released nor looked up again, so only the ones found in first candidates can be reclaimed,
+// and rejected serials are not logged.
+func newRefreshingHostLister(firstCandidates []deviceCandidate) hostLister {
+	return func(configs configsModel, host stfHost) ([]deviceCandidate, error) {
+		var ownedSerials []string
+		for _, candidate := range firstCandidates {
+			if candidate.owned && candidate.host.url == host.url {
+				ownedSerials = append(ownedSerials, candidate.serial)
+			}
+		}
+		serials, err := queryFreeSerials(configs, host, ownedSerials)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []deviceCandidate
+		for _, serial := range serials {
+			if getSerialRejection(configs, serial) == "" {
+				candidates = append(candidates, deviceCandidate{serial: serial, host: host, owned: containsString(ownedSerials, serial)})
+			}
+		}
+		return candidates, nil
+	}
+}
+
+// getRequiredDeviceNumber returns number of devices without which step fails.
+func (configs configsModel) getRequiredDeviceNumber() int {
+	if configs.deviceNumberMinimum > 1 {
+		return configs.deviceNumberMinimum
+	}
+	return 1
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"github.com/DroidsOnRoids/bitrise-step-openstf-connect/fakestf"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newBusyDeviceServer() *fakestf.Server {
+	return fakestf.NewServer(e2eToken, e2eEmail, fakestf.Device{Serial: "a", Present: true, Owner: &fakestf.Owner{Email: "other@example.com"}})
+}
+
+func newWaitConfigs() configsModel {
+	configs := newE2EConfigs()
+	configs.connectTimeout = time.Second
+	configs.deviceWaitTimeout = 5 * time.Second
+	configs.deviceWaitPollInterval = time.Minute
+	configs.deviceWaitEvents = true
+	return configs
+}
+
+func TestGetCandidatesWaitingNoWait(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newBusyDeviceServer()
+	defer server.Close()
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+
+	_, _, err := getCandidatesWaiting(newE2EConfigs(), []stfHost{host}, nil, nil)
+	require.Error(t, err)
+}
+
+func TestGetCandidatesWaitingReactsToDeviceEvents(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newBusyDeviceServer()
+	defer server.Close()
+	host := stfHost{url: server.URL, accessToken: e2eToken, sessionCookie: server.SessionCookie(e2eEmail)}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.ReleaseDevice("a")
+	}()
+
+	startTime := time.Now()
+	candidates, _, err := getCandidatesWaiting(newWaitConfigs(), []stfHost{host}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []deviceCandidate{{serial: "a", host: host}}, candidates)
+	require.True(t, time.Since(startTime) < 2*time.Second)
+}
+
+func TestListenDeviceEventsRequiresSessionCookie(t *testing.T) {
+	server := newBusyDeviceServer()
+	defer server.Close()
+	changes := make(chan struct{}, 1)
+
+	err := listenDeviceEvents(context.Background(), newWaitConfigs(), stfHost{url: server.URL, accessToken: e2eToken}, changes)
+	require.EqualError(t, err, "STF session cookie is not set")
+
+	err = listenDeviceEvents(context.Background(), newWaitConfigs(), stfHost{url: server.URL, accessToken: e2eToken, sessionCookie: "ssid=forged; ssid.sig=forged"}, changes)
+	require.EqualError(t, err, `device events rejected, error: "Missing authorization token"`)
+}
+
+func TestGetCandidatesWaitingFallsBackToPolling(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newBusyDeviceServer()
+	defer server.Close()
+	server.FailRequests("GET", fakestf.SocketIOPath, 404, -1)
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newWaitConfigs()
+	configs.deviceWaitPollInterval = 100 * time.Millisecond
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.ReleaseDevice("a")
+	}()
+
+	candidates, _, err := getCandidatesWaiting(configs, []stfHost{host}, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+}
+
+func TestGetCandidatesWaitingTimeout(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newBusyDeviceServer()
+	defer server.Close()
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newWaitConfigs()
+	configs.deviceWaitTimeout = 300 * time.Millisecond
+	configs.deviceWaitPollInterval = 100 * time.Millisecond
+
+	_, _, err := getCandidatesWaiting(configs, []stfHost{host}, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not find present, not used devices")
+}
+
+func TestGetCandidatesWaitingRefreshesOnlyDeviceList(t *testing.T) {
+	skipWithoutJQ(t)
+	server := newBusyDeviceServer()
+	defer server.Close()
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newWaitConfigs()
+	configs.deviceWaitEvents = false
+	configs.deviceWaitPollInterval = 50 * time.Millisecond
+	configs.reclaimOwnedDevices = true
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.ReleaseDevice("a")
+	}()
+
+	candidates, _, err := getCandidatesWaiting(configs, []stfHost{host}, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	require.Equal(t, 1, countRequests(server, "GET /api/v1/user/devices"))
+	require.True(t, countRequests(server, "GET /api/v1/devices") > 2)
+}
+
+func TestGetCandidatesWaitingSkipsQuarantinedDevices(t *testing.T) {
+	skipWithoutJQ(t)
+	server := fakestf.NewServer(e2eToken, e2eEmail, freeDevice("flaky"), fakestf.Device{Serial: "a", Present: true, Owner: &fakestf.Owner{Email: "other@example.com"}})
+	defer server.Close()
+	host := stfHost{url: server.URL, accessToken: e2eToken}
+	configs := newWaitConfigs()
+	configs.deviceWaitEvents = false
+	configs.deviceWaitPollInterval = 50 * time.Millisecond
+	configs.quarantineMode = quarantineModeSkip
+	configs.quarantineFailureRate = 0.5
+	configs.quarantineMinAttempts = 1
+	configs.quarantineCooldown = time.Hour
+	history := &quarantineHistory{Devices: map[string][]deviceAttempt{quarantineKey(host, "flaky"): {{Time: time.Now(), Failed: true}}}}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.ReleaseDevice("a")
+	}()
+
+	candidates, _, err := getCandidatesWaiting(configs, []stfHost{host}, nil, history)
+	require.NoError(t, err)
+	require.Len(t, candidates, 2)
+	require.Equal(t, []string{"a"}, getCandidateSerials(applyQuarantine(configs, history, candidates, time.Now())))
+}
+
+func countRequests(server *fakestf.Server, request string) int {
+	count := 0
+	for _, serverRequest := range server.Requests() {
+		if serverRequest == request {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID appended to key of websocket handshake, see RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const maxWebsocketMessageSize = 1 << 20
+
+// Used for connections through proxy when context has no deadline.
+const defaultWebsocketDialTimeout = 30 * time.Second
+
+const (
+	websocketOpContinuation = 0x0
+	websocketOpText         = 0x1
+	websocketOpBinary       = 0x2
+	websocketOpClose        = 0x8
+	websocketOpPing         = 0x9
+	websocketOpPong         = 0xA
+)
+
+// websocketConn is minimal RFC 6455 client connection, enough to receive STF events.
+// Messages are read from single goroutine while writes may come from any goroutine.
+type websocketConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+// dialWebsocket opens websocket connection to ws:// or wss:// URL, tlsConfig is used for the latter.
+// Connection is tunneled through proxy unless proxyURL is nil.
+func dialWebsocket(ctx context.Context, rawURL string, header http.Header, tlsConfig *tls.Config, proxyURL *url.URL) (*websocketConn, error) {
+	wsURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	address := wsURL.Host
+	if wsURL.Port() == "" {
+		if wsURL.Scheme == "wss" {
+			address = net.JoinHostPort(wsURL.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(wsURL.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	if proxyURL != nil {
+		timeout := defaultWebsocketDialTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		conn, err = dialThroughProxy(proxyURL, address, timeout)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	switch wsURL.Scheme {
+	case "ws":
+	case "wss":
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = wsURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, describeTLSError(err)
+		}
+		conn = tlsConn
+	default:
+		_ = conn.Close()
+		return nil, fmt.Errorf("unsupported websocket URL scheme: %s", wsURL.Scheme)
+	}
+
+	wsConn := &websocketConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := wsConn.handshake(wsURL, header); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+func (wsConn *websocketConn) handshake(wsURL *url.URL, header http.Header) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: wsURL.Path, RawPath: wsURL.RawPath, RawQuery: wsURL.RawQuery},
+		Host:       wsURL.Host,
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(wsConn.conn); err != nil {
+		return err
+	}
+
+	response, err := http.ReadResponse(wsConn.reader, req)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		_ = response.Body.Close()
+		return fmt.Errorf("websocket handshake failed, status: %s", response.Status)
+	}
+	if !strings.EqualFold(response.Header.Get("Upgrade"), "websocket") || response.Header.Get("Sec-WebSocket-Accept") != computeWebsocketAccept(key) {
+		return errors.New("websocket handshake failed, invalid upgrade response")
+	}
+	return nil
+}
+
+func computeWebsocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// readMessage returns next text or binary message, answering pings meanwhile. Closing handshake results in io.EOF.
+func (wsConn *websocketConn) readMessage() (string, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := wsConn.readFrame()
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case websocketOpPing:
+			if err := wsConn.writeFrame(websocketOpPong, payload); err != nil {
+				return "", err
+			}
+			continue
+		case websocketOpPong:
+			continue
+		case websocketOpClose:
+			if err := wsConn.writeFrame(websocketOpClose, nil); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		case websocketOpText, websocketOpBinary:
+			message = payload
+		case websocketOpContinuation:
+			message = append(message, payload...)
+		default:
+			return "", fmt.Errorf("unsupported websocket opcode: %d", opcode)
+		}
+		if len(message) > maxWebsocketMessageSize {
+			return "", errors.New("websocket message too large")
+		}
+		if fin {
+			return string(message), nil
+		}
+	}
+}
+
+func (wsConn *websocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(wsConn.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(wsConn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(wsConn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxWebsocketMessageSize {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(wsConn.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(wsConn.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskWebsocketPayload(payload, mask)
+	}
+	return fin, opcode, payload, nil
+}
+
+func (wsConn *websocketConn) writeText(message string) error {
+	return wsConn.writeFrame(websocketOpText, []byte(message))
+}
+
+// writeFrame sends single final frame, masked as required from clients.
+func (wsConn *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	maskedPayload := append([]byte(nil), payload...)
+	maskWebsocketPayload(maskedPayload, mask)
+	frame = append(frame, maskedPayload...)
+
+	wsConn.writeMutex.Lock()
+	defer wsConn.writeMutex.Unlock()
+	_, err := wsConn.conn.Write(frame)
+	return err
+}
+
+func maskWebsocketPayload(payload []byte, mask [4]byte) {
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+}
+
+func (wsConn *websocketConn) Close() error {
+	return wsConn.conn.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/DroidsOnRoids/bitrise-step-openstf-connect/fakestf"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeWebsocketAccept(t *testing.T) {
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", computeWebsocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebsocketReadMessage(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer func() {
+		require.NoError(t, clientConn.Close())
+	}()
+	wsConn := &websocketConn{conn: clientConn, reader: bufio.NewReader(clientConn)}
+
+	go func() {
+		_, _ = serverConn.Write([]byte{0x01, 3, 'd', 'e', 'v'})
+		_, _ = serverConn.Write([]byte{0x89, 2, 'h', 'i'})
+		_, _ = serverConn.Write([]byte{0x80, 4, 'i', 'c', 'e', '.'})
+		_, _ = serverConn.Write(append([]byte{0x81, 126, 0x01, 0x00}, []byte(strings.Repeat("x", 256))...))
+		_, _ = serverConn.Write([]byte{0x88, 0})
+	}()
+	pong := make(chan []byte)
+	go func() {
+		frame := make([]byte, 8)
+		_, _ = io.ReadFull(serverConn, frame)
+		maskWebsocketPayload(frame[6:], [4]byte{frame[2], frame[3], frame[4], frame[5]})
+		pong <- frame
+		_, _ = io.ReadFull(serverConn, make([]byte, 6))
+	}()
+
+	message, err := wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, "device.", message)
+	frame := <-pong
+	require.Equal(t, []byte{0x8A, 0x82}, frame[:2])
+	require.Equal(t, "hi", string(frame[6:]))
+
+	message, err = wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("x", 256), message)
+
+	_, err = wsConn.readMessage()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDialWebsocketFakeSTF(t *testing.T) {
+	server := fakestf.NewServer(e2eToken, e2eEmail, fakestf.Device{Serial: "a", Present: true, Owner: &fakestf.Owner{Email: "other@example.com"}})
+	defer server.Close()
+	wsURL, err := getWebsocketURL(server.URL)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Like STF, API access tokens are not accepted and authorization fails only after connection is established.
+	wsConn, err := dialWebsocket(ctx, wsURL, http.Header{"Authorization": {"Bearer " + e2eToken}}, nil, nil)
+	require.NoError(t, err)
+	_, err = wsConn.readMessage()
+	require.NoError(t, err)
+	message, err := wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, `44"Missing authorization token"`, message)
+	require.NoError(t, wsConn.Close())
+
+	proxy := startConnectProxy("")
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	wsConn, err = dialWebsocket(ctx, wsURL, http.Header{"Cookie": {server.SessionCookie(e2eEmail)}}, nil, proxyURL)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, wsConn.Close())
+	}()
+	message, err = wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, 25*time.Second, parseEngineIOPingInterval(message[1:]))
+	message, err = wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, "40", message)
+
+	require.NoError(t, wsConn.writeText("2"))
+	message, err = wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, "3", message)
+
+	server.ReleaseDevice("a")
+	message, err = wsConn.readMessage()
+	require.NoError(t, err)
+	require.Equal(t, "device.change", parseSocketIOEvent(message))
+}